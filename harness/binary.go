@@ -0,0 +1,64 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// SetBinary makes the RM run the goshawkdb binary at binPath instead
+// of Setup.GosBin. It is for building a program, before the RM is
+// first started: to change the binary while a program runs, use
+// SwapBinary.
+func (rm *RM) SetBinary(binPath *PathProvider) {
+	rm.Command.exePath = binPath
+}
+
+// Binary is the goshawkdb binary the RM runs when next started.
+func (rm *RM) Binary() *PathProvider {
+	return rm.Command.exePath
+}
+
+// RMSwapBinary. Changes the goshawkdb binary of a stopped RM, so that
+// it runs binPath when next started. The RM's data dir is untouched,
+// so a rolling upgrade is: terminate, wait, swap binary, start, await
+// ready, for each RM in turn.
+
+type RMSwapBinary struct {
+	*RM
+	binPath *PathProvider
+}
+
+func (rm *RM) SwapBinary(binPath *PathProvider) *RMSwapBinary {
+	return &RMSwapBinary{
+		RM:      rm,
+		binPath: binPath,
+	}
+}
+
+func (rmsb *RMSwapBinary) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmsb))
+
+	err := rmsb.stopped()
+	if err == nil {
+		_, err = os.Stat(rmsb.binPath.Path())
+	}
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Swapping binary %s for %s", rmsb.Binary().Path(), rmsb.binPath.Path())
+	rmsb.SetBinary(rmsb.binPath)
+	return nil
+}
+
+func (rmsb *RMSwapBinary) String() string {
+	return fmt.Sprintf("SwapBinary:%v", rmsb.name)
+}
+
+func (rmsb *RMSwapBinary) Describe() string {
+	return fmt.Sprintf("Swap the binary of stopped RM %s for %s", rmsb.name, describePath(rmsb.binPath))
+}
@@ -0,0 +1,358 @@
+package harness
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificates are the cluster CA and the client certificates it
+// signs. They are set up by Setup.Exec:
+//
+// - If Setup.GosCert is not set, a fresh cluster CA is generated and
+// written to <Setup.Dir>/clusterCert.pem, and GosCert is set to it.
+// Otherwise the CA is loaded from GosCert (which must contain the
+// CA's private key if any client certificates are to be generated).
+//
+// - If Setup.GosConfig is not set, then configs are generated by the
+// harness, and so Setup.Client is generated too. Otherwise the
+// hand-written config will only know about the client key pair the
+// tests would normally use (from GOSHAWKDB_CLIENT_KEYPAIR, or the
+// built-in default), so that is loaded instead.
+//
+// - Every client certificate made with NewClientCertificate is
+// generated, and written to <Setup.Dir>/<name>-client.pem.
+//
+// - The cluster CA certificate, without its private key, is written
+// to <Setup.Dir>/clusterCert-public.pem. Child processes are given
+// its path as GOSHAWKDB_CLUSTER_CERT, and the path of Setup.Client's
+// key pair (if it has been written out) as GOSHAWKDB_CLIENT_KEYPAIR,
+// so tests they run with tests.NewTestHelper use the same
+// certificates as the harness.
+type Certificates struct {
+	lock            sync.Mutex
+	caCert          *x509.Certificate
+	caKey           *ecdsa.PrivateKey
+	clusterCert     []byte
+	clusterCertPath string
+	clients         []*ClientCertificate
+}
+
+// ClusterCert is the PEM encoded cluster CA certificate, without its
+// private key.
+func (c *Certificates) ClusterCert() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.clusterCert
+}
+
+// ClientCertificate is a client key pair. Its key pair and
+// fingerprint are available once Setup.Exec has run.
+type ClientCertificate struct {
+	lock        sync.Mutex
+	name        string
+	keyPair     []byte
+	fingerprint string
+	path        *PathProvider
+	generate    bool
+}
+
+// NewClientCertificate creates a client certificate, signed by the
+// cluster CA. If Setup.Exec has already run, it is generated
+// immediately (and will panic if that fails); otherwise it is
+// generated by Setup.Exec.
+func (s *Setup) NewClientCertificate(name string) *ClientCertificate {
+	cc := &ClientCertificate{
+		name:     name,
+		path:     &PathProvider{},
+		generate: true,
+	}
+	s.Certs.lock.Lock()
+	defer s.Certs.lock.Unlock()
+	s.Certs.clients = append(s.Certs.clients, cc)
+	if s.Certs.caCert != nil {
+		if err := s.Certs.generateClient(cc, s.Dir.Path()); err != nil {
+			panic(err)
+		}
+	}
+	return cc
+}
+
+func (cc *ClientCertificate) Name() string {
+	return cc.name
+}
+
+// KeyPair is the PEM encoded certificate and private key.
+func (cc *ClientCertificate) KeyPair() []byte {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.keyPair
+}
+
+// Fingerprint is the hex encoded SHA-256 of the certificate, as used
+// in ClientCertificateFingerprints in cluster configs.
+func (cc *ClientCertificate) Fingerprint() string {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.fingerprint
+}
+
+// Path is the file the key pair has been written to, if any.
+func (cc *ClientCertificate) Path() *PathProvider {
+	return cc.path
+}
+
+func (cc *ClientCertificate) String() string {
+	return fmt.Sprintf("ClientCertificate:%v", cc.name)
+}
+
+func (cc *ClientCertificate) setKeyPair(keyPair []byte) error {
+	fingerprint, err := fingerprint(keyPair)
+	if err != nil {
+		return err
+	}
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.keyPair = keyPair
+	cc.fingerprint = fingerprint
+	return nil
+}
+
+// initCertificates is called from Setup.Exec.
+func (s *Setup) initCertificates(l *log.Logger) error {
+	s.Client.generate = len(s.GosConfig.Path()) == 0
+	if !s.Client.generate {
+		th, _, err := s.newTestHelper(l, nil)
+		if err != nil {
+			return err
+		}
+		if err = s.Client.setKeyPair(th.ClientKeyPair); err != nil {
+			return err
+		}
+	}
+
+	c := s.Certs
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	dir := s.Dir.Path()
+	if certPath := s.GosCert.Path(); len(certPath) == 0 {
+		path := filepath.Join(dir, "clusterCert.pem")
+		if err := c.generateCA(path); err != nil {
+			return err
+		}
+		if err := s.GosCert.SetPath(path, false); err != nil {
+			return err
+		}
+		l.Printf("Generated cluster certificate in %s", path)
+	} else if err := c.loadCA(certPath); err != nil {
+		return err
+	}
+
+	for _, cc := range c.clients {
+		if !cc.generate {
+			continue
+		}
+		if err := c.generateClient(cc, dir); err != nil {
+			return err
+		}
+		l.Printf("Generated client certificate %s with fingerprint %s in %s", cc.name, cc.Fingerprint(), cc.path.Path())
+	}
+
+	path := filepath.Join(dir, "clusterCert-public.pem")
+	if err := ioutil.WriteFile(path, c.clusterCert, 0644); err != nil {
+		return err
+	}
+	c.clusterCertPath = path
+	return nil
+}
+
+// childEnv is the environment for a child process: env, or the
+// harness's own environment if env is nil, plus GOSHAWKDB_CLUSTER_CERT
+// and GOSHAWKDB_CLIENT_KEYPAIR for the harness's certificates unless
+// env already sets them.
+func (s *Setup) childEnv(env []string) []string {
+	if env == nil {
+		env = os.Environ()
+	}
+	s.Certs.lock.Lock()
+	clusterCertPath := s.Certs.clusterCertPath
+	s.Certs.lock.Unlock()
+	vars := [][2]string{
+		{"GOSHAWKDB_CLUSTER_CERT", clusterCertPath},
+		{"GOSHAWKDB_CLIENT_KEYPAIR", s.Client.Path().Path()},
+	}
+	result := append([]string{}, env...)
+	for _, kv := range vars {
+		if len(kv[1]) > 0 && !hasEnv(env, kv[0]) {
+			result = append(result, fmt.Sprintf("%s=%s", kv[0], kv[1]))
+		}
+	}
+	return result
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certificates) generateCA(path string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate("Cluster CA Root Certificate")
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageCertSign
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(certPEM, keyPEM...), 0600); err != nil {
+		return err
+	}
+	c.caCert = cert
+	c.caKey = key
+	c.clusterCert = certPEM
+	return nil
+}
+
+// loadCA reads the first certificate, and the private key if there
+// is one, from path.
+func (c *Certificates) loadCA(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.caCert == nil {
+				if c.caCert, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return err
+				}
+				c.clusterCert = pem.EncodeToMemory(block)
+			}
+		case "EC PRIVATE KEY":
+			if c.caKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+	if c.caCert == nil {
+		return fmt.Errorf("No certificate found in %s", path)
+	}
+	return nil
+}
+
+func (c *Certificates) generateClient(cc *ClientCertificate, dir string) error {
+	if c.caKey == nil {
+		return fmt.Errorf("Unable to generate client certificate %s: no cluster CA private key", cc.name)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate(cc.name)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	template.BasicConstraintsValid = true
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caCert, &key.PublicKey, c.caKey)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	keyPair := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM...)
+	path := filepath.Join(dir, fmt.Sprintf("%s-client.pem", cc.name))
+	if err = ioutil.WriteFile(path, keyPair, 0600); err != nil {
+		return err
+	}
+	if err = cc.path.SetPath(path, false); err != nil {
+		return err
+	}
+	return cc.setKeyPair(keyPair)
+}
+
+func certificateTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"GoshawkDB"},
+			CommonName:   commonName,
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.AddDate(10, 0, 0),
+	}, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// fingerprint finds the first certificate in keyPair and returns the
+// hex encoded SHA-256 of it.
+func fingerprint(keyPair []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, keyPair = pem.Decode(keyPair)
+		if block == nil {
+			return "", errors.New("No certificate found in client key pair")
+		}
+		if block.Type == "CERTIFICATE" {
+			sum := sha256.Sum256(block.Bytes)
+			return hex.EncodeToString(sum[:]), nil
+		}
+	}
+}
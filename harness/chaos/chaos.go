@@ -0,0 +1,196 @@
+// Package chaos provides common patterns of failure for soaks, built
+// from harness instructions. Every random choice they make (which
+// RMs, how long to wait) goes through the Setup, so is logged and can
+// be replayed. A typical soak runs one or more of them periodically
+// alongside a workload:
+//
+//	servers := chaos.Periodically(setup, chaos.Interval{Min: 5 * time.Second, Max: 10 * time.Second},
+//		chaos.RandomMinorityKill(setup, rms, chaos.Interval{Min: time.Second, Max: 5 * time.Second}),
+//		chaos.StaggeredSIGHUP(setup, rms, chaos.Interval{Min: time.Second}))
+//
+// Patterns that kill or stop RMs check, as they restart them, that
+// they did not panic, and they wait for them to be ready again before
+// finishing.
+package chaos
+
+import (
+	"fmt"
+	h "goshawkdb.io/tests/harness"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Interval is a range of durations to wait for: a uniformly random
+// duration between Min and Max, or exactly Min if Max is not greater.
+type Interval struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (i Interval) sleep(s *h.Setup) h.Instruction {
+	if i.Max > i.Min {
+		return s.SleepRandom(i.Min, i.Max)
+	}
+	return s.Sleep(i.Min)
+}
+
+func (i Interval) String() string {
+	if i.Max > i.Min {
+		return fmt.Sprintf("%v-%v", i.Min, i.Max)
+	}
+	return i.Min.String()
+}
+
+// Periodically repeats until stopped: wait for every, then run one of
+// the patterns, picked at random.
+func Periodically(s *h.Setup, every Interval, patterns ...h.Instruction) *h.UntilStopped {
+	var pattern h.Instruction
+	if len(patterns) == 1 {
+		pattern = patterns[0]
+	} else {
+		pattern = s.PickOne(patterns...)
+	}
+	return s.UntilStopped(h.Program{every.sleep(s), pattern})
+}
+
+// RollingRestart terminates and restarts each RM in turn, waiting for
+// each to be ready again and then for gap before moving on.
+func RollingRestart(s *h.Setup, rms []*h.RM, gap Interval) h.Instruction {
+	prog := h.Program{}
+	for _, rm := range rms {
+		prog = append(prog,
+			rm.Terminate(),
+			rm.ExpectExit(false),
+			rm.Start(),
+			rm.AwaitReady(),
+			gap.sleep(s))
+	}
+	return s.Named("RollingRestart",
+		fmt.Sprintf("Rolling restart of %v, %v apart", names(rms), gap), prog)
+}
+
+// StaggeredRestart gracefully terminates each of rms in turn, gap
+// apart, waits for them all to exit, and then restarts them in the
+// reverse order, each after a further gap. Unlike the kill patterns,
+// the RMs get to shut down cleanly, and leave and rejoin the cluster
+// one at a time.
+func StaggeredRestart(s *h.Setup, rms []*h.RM, gap Interval) h.Instruction {
+	prog := h.Program{}
+	for idx, rm := range rms {
+		if idx > 0 {
+			prog = append(prog, gap.sleep(s))
+		}
+		prog = append(prog, rm.Terminate())
+	}
+	for _, rm := range rms {
+		prog = append(prog, rm.ExpectExit(false))
+	}
+	for idx := len(rms) - 1; idx >= 0; idx-- {
+		prog = append(prog, gap.sleep(s), rms[idx].Start())
+	}
+	for _, rm := range rms {
+		prog = append(prog, rm.AwaitReady())
+	}
+	return s.Named("StaggeredRestart",
+		fmt.Sprintf("Terminate %v in turn and restart them in reverse, %v apart", names(rms), gap), prog)
+}
+
+// RandomKill kills count RMs picked at random from rms, keeps them
+// down for down, and then restarts them.
+func RandomKill(s *h.Setup, rms []*h.RM, count int, down Interval) h.Instruction {
+	return s.Named(fmt.Sprintf("RandomKill %d", count),
+		fmt.Sprintf("Kill %d of %v at random, down for %v", count, names(rms), down),
+		s.PickRMs(rms, count, count, func(picked []*h.RM) h.Instruction {
+			return killAndRestart(s, picked, down)
+		}))
+}
+
+// RandomMinorityKill kills a random minority of rms: a randomly sized
+// subset of at most (len(rms)-1)/2 of them, so the cluster should
+// keep working if rms are all its RMs and F is that large. They are
+// kept down for down, and then restarted.
+func RandomMinorityKill(s *h.Setup, rms []*h.RM, down Interval) h.Instruction {
+	max := (len(rms) - 1) / 2
+	if max < 1 {
+		return s.Log("Too few RMs to kill any")
+	}
+	return s.Named("RandomMinorityKill",
+		fmt.Sprintf("Kill a minority of %v at random, down for %v", names(rms), down),
+		s.PickRMs(rms, 1, max, func(picked []*h.RM) h.Instruction {
+			return killAndRestart(s, picked, down)
+		}))
+}
+
+func killAndRestart(s *h.Setup, rms []*h.RM, down Interval) h.Instruction {
+	kills := make([]h.Instruction, len(rms))
+	exits := make([]h.Instruction, len(rms))
+	starts := make([]h.Instruction, len(rms))
+	readies := make([]h.Instruction, len(rms))
+	for idx, rm := range rms {
+		kills[idx] = rm.Kill()
+		exits[idx] = rm.ExpectExit(false)
+		starts[idx] = rm.Start()
+		readies[idx] = rm.AwaitReady()
+	}
+	return h.Program{
+		s.InParallel(kills...),
+		s.InParallel(exits...),
+		down.sleep(s),
+		s.InParallel(starts...),
+		s.InParallel(readies...),
+	}
+}
+
+// Flap kills and restarts rm again and again, times times, leaving it
+// up for up and down for down each time. Use it on the RM a workload
+// is connected to, or whichever RM is busiest, to approximate leader
+// churn.
+func Flap(s *h.Setup, rm *h.RM, times int, up, down Interval) h.Instruction {
+	return s.Named(fmt.Sprintf("Flap %d", times),
+		fmt.Sprintf("Flap %v %d times, up for %v, down for %v", rm.Name(), times, up, down),
+		s.Repeat(times, h.Program{
+			up.sleep(s),
+			rm.Kill(),
+			rm.ExpectExit(false),
+			down.sleep(s),
+			rm.Start(),
+			rm.AwaitReady(),
+		}))
+}
+
+// KillAllAndRecover kills every RM at once, keeps them all down for
+// down, and then restarts them all, as after a power cut.
+func KillAllAndRecover(s *h.Setup, rms []*h.RM, down Interval) h.Instruction {
+	return s.Named("KillAllAndRecover",
+		fmt.Sprintf("Kill all of %v, down for %v, then recover", names(rms), down),
+		killAndRestart(s, rms, down))
+}
+
+// StaggeredSignal sends sig to each RM in turn, waiting gap between
+// them.
+func StaggeredSignal(s *h.Setup, rms []*h.RM, sig os.Signal, gap Interval) h.Instruction {
+	prog := h.Program{}
+	for idx, rm := range rms {
+		if idx > 0 {
+			prog = append(prog, gap.sleep(s))
+		}
+		prog = append(prog, rm.Signal(sig))
+	}
+	return s.Named(fmt.Sprintf("Staggered %v", sig),
+		fmt.Sprintf("Send %v to each of %v, %v apart", sig, names(rms), gap), prog)
+}
+
+// StaggeredSIGHUP sends SIGHUP to each RM in turn, waiting gap between
+// them.
+func StaggeredSIGHUP(s *h.Setup, rms []*h.RM, gap Interval) h.Instruction {
+	return StaggeredSignal(s, rms, syscall.SIGHUP, gap)
+}
+
+func names(rms []*h.RM) []string {
+	strs := make([]string, len(rms))
+	for idx, rm := range rms {
+		strs[idx] = rm.Name()
+	}
+	return strs
+}
@@ -0,0 +1,218 @@
+package harness
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DirPolicy says what Setup.Cleanup does with Setup.Dir.
+type DirPolicy string
+
+const (
+	// KeepDir leaves Setup.Dir alone. This is the default.
+	KeepDir DirPolicy = "keep"
+	// DeleteDir removes Setup.Dir and everything in it.
+	DeleteDir DirPolicy = "delete"
+	// ArchiveDir writes Setup.Dir to <Setup.ArchiveTo>/<name>.tar.gz,
+	// and then removes it.
+	ArchiveDir DirPolicy = "archive"
+)
+
+func ParseDirPolicy(str string) (DirPolicy, error) {
+	switch policy := DirPolicy(str); policy {
+	case KeepDir, DeleteDir, ArchiveDir:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Unknown dir policy: %s", str)
+	}
+}
+
+// Cleanup stops every process started from the Setup which is still
+// running: each is sent SIGTERM, and then SIGKILL if it has not
+// exited within Setup.StopGrace. Once they have all exited and their
+// output has been drained, Setup.Dir is dealt with according to
+// Setup.DirPolicy. Run calls Cleanup whether the program succeeds,
+// fails or is interrupted.
+func (s *Setup) Cleanup(l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|Cleanup", parentPrefix))
+
+	var errs Errors
+	policy := s.DirPolicy
+	if err := s.processes.terminate(l, s.StopGrace); err != nil {
+		errs = append(errs, err)
+		if policy != KeepDir {
+			l.Printf("Keeping %s as processes may still be using it", s.Dir.Path())
+			policy = KeepDir
+		}
+	}
+	for _, rm := range s.rms {
+		rm.reservation.release()
+	}
+
+	s.rngLock.Lock()
+	if s.recorder != nil {
+		s.recorder.Close()
+		s.recorder = nil
+	}
+	s.rngLock.Unlock()
+
+	if dir := s.Dir.Path(); len(dir) > 0 {
+		switch policy {
+		case DeleteDir:
+			l.Printf("Deleting %s", dir)
+			if err := removeDir(dir); err != nil {
+				errs = append(errs, err)
+			}
+		case ArchiveDir:
+			archive := filepath.Join(s.ArchiveTo, filepath.Base(dir)+".tar.gz")
+			l.Printf("Archiving %s to %s", dir, archive)
+			if err := archiveDir(dir, archive); err != nil {
+				errs = append(errs, err)
+			} else if err = removeDir(dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		l.Printf("Error encountered: %v", errs)
+		return errs
+	}
+	return nil
+}
+
+// terminate stops every tracked process which has not yet exited,
+// escalating from SIGTERM to SIGKILL after grace.
+func (pt *processTracker) terminate(l *log.Logger, grace time.Duration) error {
+	pt.lock.Lock()
+	running := make([]*trackedProcess, 0, len(pt.processes))
+	for _, tp := range pt.processes {
+		select {
+		case <-tp.exited:
+		default:
+			running = append(running, tp)
+		}
+	}
+	pt.lock.Unlock()
+
+	for _, tp := range running {
+		l.Printf("Terminating process %v", tp.process.Pid)
+		tp.process.Signal(syscall.SIGTERM)
+		// In case it is paused.
+		tp.process.Signal(syscall.SIGCONT)
+	}
+	if waitExited(running, grace) {
+		return nil
+	}
+	for _, tp := range running {
+		select {
+		case <-tp.exited:
+		default:
+			l.Printf("Killing process %v", tp.process.Pid)
+			tp.process.Kill()
+		}
+	}
+	// exited is only closed once the process's output has been
+	// drained, which may never happen if it has left children
+	// holding its stdout or stderr open.
+	if !waitExited(running, grace) {
+		return fmt.Errorf("Processes did not exit within %v of being killed", grace)
+	}
+	return nil
+}
+
+func waitExited(tps []*trackedProcess, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, tp := range tps {
+		select {
+		case <-tp.exited:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// removeDir removes dir and everything in it, except that if dir is a
+// filesystem of its own (such as a tmpfs given as -dir for FillDisk),
+// only its contents are removed.
+func removeDir(dir string) error {
+	if ownFilesystem(dir) != nil {
+		return os.RemoveAll(dir)
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+func archiveDir(dir, archive string) (err error) {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	base := filepath.Dir(dir)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(base, path); err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(header); err != nil || info.IsDir() {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,266 @@
+package harness
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"goshawkdb.io/tests"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync"
+)
+
+// harnessTest adapts a log.Logger to tests.TestInterface. Fatal
+// records the failure and cancels the workload's context, so the
+// workload fails even if Fatal is called from a goroutine of its own.
+// Like testing.T, it then ends the calling goroutine rather than the
+// whole process.
+type harnessTest struct {
+	*log.Logger
+	lock   sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func (ht *harnessTest) Fatal(args ...interface{}) {
+	ht.fail(errors.New(fmt.Sprint(args...)))
+}
+
+func (ht *harnessTest) Fatalf(format string, args ...interface{}) {
+	ht.fail(fmt.Errorf(format, args...))
+}
+
+func (ht *harnessTest) Log(args ...interface{}) {
+	ht.Print(args...)
+}
+
+func (ht *harnessTest) Logf(format string, args ...interface{}) {
+	ht.Printf(format, args...)
+}
+
+func (ht *harnessTest) fail(err error) {
+	ht.Printf("Fatal: %v", err)
+	ht.lock.Lock()
+	if ht.err == nil {
+		ht.err = err
+	}
+	cancel := ht.cancel
+	ht.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	runtime.Goexit()
+}
+
+func (ht *harnessTest) setCancel(cancel context.CancelFunc) {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	ht.cancel = cancel
+}
+
+func (ht *harnessTest) Err() error {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	return ht.err
+}
+
+// newTestHelper creates a TestHelper which talks to the given hosts,
+// trusts the cluster CA in Setup.Certs and uses the key pair of
+// Setup.Client. Until Setup.Exec has run, these fall back to the
+// certificate in Setup.GosCert and the key pair from the environment
+// as usual.
+func (s *Setup) newTestHelper(l *log.Logger, hosts []string) (*tests.TestHelper, *harnessTest, error) {
+	ht := &harnessTest{Logger: l}
+	var th *tests.TestHelper
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		th = tests.NewTestHelper(ht)
+	}()
+	<-done
+	if err := ht.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := s.configureTestHelper(th, hosts); err != nil {
+		return nil, nil, err
+	}
+	return th, ht, nil
+}
+
+func (s *Setup) configureTestHelper(th *tests.TestHelper, hosts []string) error {
+	th.ClusterHosts = hosts
+	if keyPair := s.Client.KeyPair(); len(keyPair) > 0 {
+		th.ClientKeyPair = keyPair
+	}
+	if clusterCert := s.Certs.ClusterCert(); len(clusterCert) > 0 {
+		th.ClusterCert = clusterCert
+	} else if certPath := s.GosCert.Path(); len(certPath) > 0 {
+		cert, err := clusterCertificate(certPath)
+		if err != nil {
+			return err
+		}
+		th.ClusterCert = cert
+	}
+	return nil
+}
+
+// NewTestHelper creates a TestHelper for client code outside the
+// harness's own workloads, such as a soak's own checks. It talks to
+// the given RMs (or every running RM if none are given), and uses the
+// same certificates as the harness: the generated cluster CA and
+// Setup.Client's key pair. Use it once Setup.Exec has run. Errors are
+// reported through t.Fatal.
+func (s *Setup) NewTestHelper(t tests.TestInterface, rms ...*RM) *tests.TestHelper {
+	if len(rms) == 0 {
+		rms = s.runningRMs()
+		if len(rms) == 0 {
+			t.Fatal("No running RMs for the TestHelper to talk to")
+		}
+	}
+	hosts := make([]string, len(rms))
+	for idx, rm := range rms {
+		hosts[idx] = rm.Host()
+	}
+	th := tests.NewTestHelper(t)
+	if err := s.configureTestHelper(th, hosts); err != nil {
+		t.Fatal(err)
+	}
+	return th
+}
+
+// clusterCertificate extracts just the certificate blocks from a file
+// which contains both the cluster certificate and its key pair.
+func clusterCertificate(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	result := []byte{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			result = append(result, pem.EncodeToMemory(block)...)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No certificate found in %s", path)
+	}
+	return result, nil
+}
+
+// Workload. Runs a client test function in-process against a set of
+// RMs. If no RMs are given, every RM created from the Setup which is
+// running when the workload starts is used.
+
+type Workload struct {
+	setup *Setup
+	name  string
+	fun   func(*tests.TestHelper)
+	rms   []*RM
+}
+
+func (s *Setup) Workload(name string, fun func(*tests.TestHelper), rms ...*RM) *Workload {
+	return &Workload{
+		setup: s,
+		name:  name,
+		fun:   fun,
+		rms:   rms,
+	}
+}
+
+func (w *Workload) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, w))
+
+	rms := w.rms
+	if len(rms) == 0 {
+		rms = w.setup.runningRMs()
+		if len(rms) == 0 {
+			err := errors.New("No running RMs to run the workload against")
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	hosts := make([]string, len(rms))
+	for idx, rm := range rms {
+		hosts[idx] = rm.Host()
+	}
+
+	th, ht, err := w.setup.newTestHelper(l, hosts)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+
+	workloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ht.setCancel(cancel)
+
+	l.Printf("Running against %v...", hosts)
+	var panicErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr = fmt.Errorf("Workload %s panicked: %v", w.name, r)
+			}
+		}()
+		w.fun(th)
+	}()
+	select {
+	case <-done:
+		if err = ht.Err(); err == nil {
+			err = panicErr
+		}
+	case <-workloadCtx.Done():
+		// The workload cannot be interrupted, so it is abandoned,
+		// either because it has failed or because ctx is done.
+		if err = ht.Err(); err == nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Running against %v...done", hosts)
+	return nil
+}
+
+func (w *Workload) String() string {
+	return fmt.Sprintf("Workload:%v", w.name)
+}
+
+func (w *Workload) Describe() string {
+	if len(w.rms) == 0 {
+		return fmt.Sprintf("Run workload %s against all running RMs", w.name)
+	}
+	return fmt.Sprintf("Run workload %s against %v", w.name, rmNames(w.rms))
+}
+
+// runningRMs are the RMs whose processes are currently running.
+func (s *Setup) runningRMs() []*RM {
+	rms := []*RM{}
+	for _, rm := range s.rms {
+		if rm.Pid() != 0 {
+			rms = append(rms, rm)
+		}
+	}
+	return rms
+}
+
+var workloads = make(map[string]func(*tests.TestHelper))
+
+// RegisterWorkload makes a workload available to scenario files
+// under the given name.
+func RegisterWorkload(name string, fun func(*tests.TestHelper)) {
+	workloads[name] = fun
+}
@@ -0,0 +1,55 @@
+package harness
+
+import (
+	"context"
+	"goshawkdb.io/tests"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func discardLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+// A workload fails as soon as any of its goroutines calls Fatal, even
+// if its own goroutine never returns.
+func TestWorkloadFatal(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	cases := []struct {
+		name string
+		fun  func(*tests.TestHelper)
+		err  string
+	}{
+		{"passes", func(th *tests.TestHelper) {}, ""},
+		{"fatal", func(th *tests.TestHelper) {
+			th.Fatal("own goroutine")
+		}, "own goroutine"},
+		{"fatal in child", func(th *tests.TestHelper) {
+			go th.Fatalf("child %d", 1)
+			<-stuck
+		}, "child 1"},
+		{"panic", func(th *tests.TestHelper) {
+			panic("oops")
+		}, "panicked: oops"},
+	}
+	for _, c := range cases {
+		s := NewSetup()
+		w := s.Workload(c.name, c.fun, s.NewRM("one", 10001, nil, nil))
+		errChan := make(chan error, 1)
+		go func() { errChan <- w.Exec(context.Background(), discardLogger()) }()
+		select {
+		case err := <-errChan:
+			if len(c.err) == 0 && err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if len(c.err) > 0 && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Errorf("%s: got error %v; expected %q", c.name, err, c.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: workload still running", c.name)
+		}
+	}
+}
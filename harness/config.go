@@ -0,0 +1,199 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// ClusterConfig builds a GoshawkDB cluster configuration from a set
+// of RMs, so that configurations (and changes to them) can be
+// expressed in code rather than as hand-maintained JSON files. Pass
+// Path() as the config path to NewRM, and use Write or Update to
+// write out each version.
+type ClusterConfig struct {
+	setup      *Setup
+	lock       sync.Mutex
+	path       *PathProvider
+	ClusterId  string
+	Version    uint32
+	RMs        []*RM
+	F          uint8
+	MaxRMCount uint16
+	NoSync     bool
+	// Fingerprint -> root name -> capability.
+	ClientCertificateFingerprints map[string]map[string]*RootCapability
+	// As above, for client certificates whose fingerprints are not
+	// known until Setup.Exec has run.
+	ClientCertificates map[*ClientCertificate]map[string]*RootCapability
+}
+
+type RootCapability struct {
+	Read  bool
+	Write bool
+}
+
+// clusterConfigJSON is the format of the config file itself.
+type clusterConfigJSON struct {
+	ClusterId                     string
+	Version                       uint32
+	Hosts                         []string
+	F                             uint8
+	MaxRMCount                    uint16
+	NoSync                        bool
+	ClientCertificateFingerprints map[string]map[string]*RootCapability
+}
+
+// NewClusterConfig creates a config for the given RMs. Setup.Client
+// is granted read and write on the "test" root, and on the root used
+// by Integrity.
+func (s *Setup) NewClusterConfig(clusterId string, f uint8, maxRMCount uint16, rms ...*RM) *ClusterConfig {
+	cc := &ClusterConfig{
+		setup:                         s,
+		path:                          &PathProvider{},
+		ClusterId:                     clusterId,
+		RMs:                           rms,
+		F:                             f,
+		MaxRMCount:                    maxRMCount,
+		NoSync:                        true,
+		ClientCertificateFingerprints: make(map[string]map[string]*RootCapability),
+		ClientCertificates:            make(map[*ClientCertificate]map[string]*RootCapability),
+	}
+	cc.GrantClient(s.Client, "test", true, true)
+	cc.GrantClient(s.Client, integrityRootName, true, true)
+	return cc
+}
+
+// Grant gives the client with the given certificate fingerprint
+// access to the named root. It only affects versions written after
+// it is called.
+func (cc *ClusterConfig) Grant(fingerprint, root string, read, write bool) *ClusterConfig {
+	roots, found := cc.ClientCertificateFingerprints[fingerprint]
+	if !found {
+		roots = make(map[string]*RootCapability)
+		cc.ClientCertificateFingerprints[fingerprint] = roots
+	}
+	roots[root] = &RootCapability{Read: read, Write: write}
+	return cc
+}
+
+// GrantClient is like Grant, for a client certificate created with
+// NewClientCertificate.
+func (cc *ClusterConfig) GrantClient(client *ClientCertificate, root string, read, write bool) *ClusterConfig {
+	roots, found := cc.ClientCertificates[client]
+	if !found {
+		roots = make(map[string]*RootCapability)
+		cc.ClientCertificates[client] = roots
+	}
+	roots[root] = &RootCapability{Read: read, Write: write}
+	return cc
+}
+
+// Path is the path of the config file, which is filled in once the
+// first version is written.
+func (cc *ClusterConfig) Path() *PathProvider {
+	return cc.path
+}
+
+// Hosts are the host:port of each RM, as they appear in the config.
+func (cc *ClusterConfig) Hosts() []string {
+	hosts := make([]string, len(cc.RMs))
+	for idx, rm := range cc.RMs {
+		hosts[idx] = rm.Host()
+	}
+	return hosts
+}
+
+func (cc *ClusterConfig) MarshalJSON() ([]byte, error) {
+	hosts := cc.Hosts()
+	fingerprints := make(map[string]map[string]*RootCapability, len(cc.ClientCertificateFingerprints)+len(cc.ClientCertificates))
+	for fingerprint, roots := range cc.ClientCertificateFingerprints {
+		fingerprints[fingerprint] = roots
+	}
+	for client, roots := range cc.ClientCertificates {
+		fingerprint := client.Fingerprint()
+		if len(fingerprint) == 0 {
+			return nil, fmt.Errorf("Client certificate %s has not been generated", client.Name())
+		}
+		merged, found := fingerprints[fingerprint]
+		if !found {
+			merged = make(map[string]*RootCapability, len(roots))
+			fingerprints[fingerprint] = merged
+		}
+		for root, capability := range roots {
+			merged[root] = capability
+		}
+	}
+	return json.MarshalIndent(&clusterConfigJSON{
+		ClusterId:                     cc.ClusterId,
+		Version:                       cc.Version,
+		Hosts:                         hosts,
+		F:                             cc.F,
+		MaxRMCount:                    cc.MaxRMCount,
+		NoSync:                        cc.NoSync,
+		ClientCertificateFingerprints: fingerprints,
+	}, "", "    ")
+}
+
+// ClusterConfigWrite. Applies a change (if any) to the config, bumps
+// its Version, and writes it to <Setup.Dir>/<ClusterId>.json. The
+// file is overwritten in place so that running RMs pick up the new
+// version when sent SIGHUP. A copy of each version is kept alongside.
+
+type ClusterConfigWrite struct {
+	*ClusterConfig
+	change func(*ClusterConfig)
+}
+
+func (cc *ClusterConfig) Write() *ClusterConfigWrite {
+	return cc.Update(nil)
+}
+
+func (cc *ClusterConfig) Update(change func(*ClusterConfig)) *ClusterConfigWrite {
+	return &ClusterConfigWrite{
+		ClusterConfig: cc,
+		change:        change,
+	}
+}
+
+func (ccw *ClusterConfigWrite) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ccw))
+
+	ccw.lock.Lock()
+	defer ccw.lock.Unlock()
+	if ccw.change != nil {
+		ccw.change(ccw.ClusterConfig)
+	}
+	ccw.Version++
+
+	data, err := ccw.MarshalJSON()
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	dir := ccw.setup.Dir.Path()
+	dest := filepath.Join(dir, fmt.Sprintf("%s.json", ccw.ClusterId))
+	versioned := filepath.Join(dir, fmt.Sprintf("%s-v%d.json", ccw.ClusterId, ccw.Version))
+	l.Printf("Writing version %d with hosts %v to %s", ccw.Version, rmNames(ccw.RMs), dest)
+	for _, path := range []string{versioned, dest} {
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	return ccw.path.SetPath(dest, false)
+}
+
+func (ccw *ClusterConfigWrite) String() string {
+	return fmt.Sprintf("ClusterConfigWrite:%v", ccw.ClusterId)
+}
+
+func (ccw *ClusterConfigWrite) Describe() string {
+	return fmt.Sprintf("Write the next config version of cluster %s", ccw.ClusterId)
+}
@@ -0,0 +1,487 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Repeat. Runs the wrapped instruction n times, stopping on error.
+
+type Repeat struct {
+	wrapped Instruction
+	n       int
+}
+
+func (s *Setup) Repeat(n int, instr Instruction) *Repeat {
+	return &Repeat{
+		wrapped: instr,
+		n:       n,
+	}
+}
+
+func (r *Repeat) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	for idx := 0; idx < r.n; idx++ {
+		l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, r, idx))
+		if err := ctx.Err(); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		if err := execInstruction(ctx, l, r.wrapped); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repeat) String() string {
+	return fmt.Sprintf("Repeat %v", r.n)
+}
+
+func (r *Repeat) Describe() string {
+	return fmt.Sprintf("Repeat %d times", r.n)
+}
+
+func (r *Repeat) Walk(fun func(Instruction)) {
+	fun(r.wrapped)
+}
+
+// RepeatFor. Runs the wrapped instruction again and again until d has
+// elapsed, stopping on error. The final iteration is not interrupted
+// at the deadline: wrap it in WithTimeout if that matters.
+
+type RepeatFor struct {
+	wrapped Instruction
+	d       time.Duration
+}
+
+func (s *Setup) RepeatFor(d time.Duration, instr Instruction) *RepeatFor {
+	return &RepeatFor{
+		wrapped: instr,
+		d:       d,
+	}
+}
+
+func (rf *RepeatFor) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	deadline := time.Now().Add(rf.d)
+	for idx := 0; time.Now().Before(deadline); idx++ {
+		l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, rf, idx))
+		if err := ctx.Err(); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		if err := execInstruction(ctx, l, rf.wrapped); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (rf *RepeatFor) String() string {
+	return fmt.Sprintf("RepeatFor %v", rf.d)
+}
+
+func (rf *RepeatFor) Describe() string {
+	return fmt.Sprintf("Repeat for %v", rf.d)
+}
+
+func (rf *RepeatFor) Walk(fun func(Instruction)) {
+	fun(rf.wrapped)
+}
+
+// PickWeighted. Like PickOne, but each instruction is picked with
+// probability proportional to its weight.
+
+type WeightedChoice struct {
+	Weight      uint
+	Instruction Instruction
+}
+
+type PickWeighted struct {
+	setup   *Setup
+	choices []WeightedChoice
+}
+
+func (s *Setup) PickWeighted(choices ...WeightedChoice) *PickWeighted {
+	return &PickWeighted{
+		setup:   s,
+		choices: choices,
+	}
+}
+
+func (pw *PickWeighted) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, pw))
+	total := int64(0)
+	for _, choice := range pw.choices {
+		total += int64(choice.Weight)
+	}
+	if total == 0 {
+		err := errors.New("No choice has a positive weight")
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	n := pw.setup.decide(l, total)
+	picked := 0
+	for idx, choice := range pw.choices {
+		if n < int64(choice.Weight) {
+			picked = idx
+			break
+		}
+		n -= int64(choice.Weight)
+	}
+	l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, pw, picked))
+	if err := execInstruction(ctx, l, pw.choices[picked].Instruction); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (pw *PickWeighted) String() string {
+	return fmt.Sprintf("PickWeighted %v", len(pw.choices))
+}
+
+func (pw *PickWeighted) Describe() string {
+	weights := make([]uint, len(pw.choices))
+	for idx, choice := range pw.choices {
+		weights[idx] = choice.Weight
+	}
+	return fmt.Sprintf("Pick one at random, weighted %v", weights)
+}
+
+func (pw *PickWeighted) Walk(fun func(Instruction)) {
+	for _, choice := range pw.choices {
+		fun(choice.Instruction)
+	}
+}
+
+// PickRMs. Picks between min and max of the RMs at random when it is
+// run, and runs the instruction build makes for them. The number is
+// picked first, uniformly, and then each member in turn, each as a
+// decision of its own, so every number is equally likely and every
+// pick can be replayed.
+
+type PickRMs struct {
+	setup *Setup
+	rms   []*RM
+	min   int
+	max   int
+	build func([]*RM) Instruction
+}
+
+func (s *Setup) PickRMs(rms []*RM, min, max int, build func([]*RM) Instruction) *PickRMs {
+	return &PickRMs{
+		setup: s,
+		rms:   rms,
+		min:   min,
+		max:   max,
+		build: build,
+	}
+}
+
+func (pr *PickRMs) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	prefix := fmt.Sprintf("%s|%v", parentPrefix, pr)
+
+	picked, err := pr.pick(func(suffix string, n int) int {
+		l.SetPrefix(prefix + suffix)
+		return int(pr.setup.decide(l, int64(n)))
+	})
+	l.SetPrefix(prefix)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Picked %v", rmNames(picked))
+	if err := execInstruction(ctx, l, pr.build(picked)); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return nil
+}
+
+// pick chooses the RMs, using decide(suffix, n) for each choice of a
+// value in [0,n). The RMs picked are returned in their original order.
+func (pr *PickRMs) pick(decide func(suffix string, n int) int) ([]*RM, error) {
+	min, max := pr.min, pr.max
+	if min < 1 {
+		min = 1
+	}
+	if max > len(pr.rms) {
+		max = len(pr.rms)
+	}
+	if min > max {
+		return nil, fmt.Errorf("Unable to pick between %d and %d of %d RMs", pr.min, pr.max, len(pr.rms))
+	}
+	count := min + decide("|count", max-min+1)
+	remaining := make([]int, len(pr.rms))
+	for idx := range remaining {
+		remaining[idx] = idx
+	}
+	chosen := make([]bool, len(pr.rms))
+	for idx := 0; idx < count; idx++ {
+		n := decide(fmt.Sprintf("|member(%d)", idx), len(remaining))
+		chosen[remaining[n]] = true
+		remaining = append(remaining[:n], remaining[n+1:]...)
+	}
+	picked := make([]*RM, 0, count)
+	for idx, rm := range pr.rms {
+		if chosen[idx] {
+			picked = append(picked, rm)
+		}
+	}
+	return picked, nil
+}
+
+func (pr *PickRMs) String() string {
+	return "PickRMs"
+}
+
+func (pr *PickRMs) Describe() string {
+	if pr.min == pr.max {
+		return fmt.Sprintf("Pick %d of %v at random", pr.min, rmNames(pr.rms))
+	}
+	return fmt.Sprintf("Pick %d to %d of %v at random", pr.min, pr.max, rmNames(pr.rms))
+}
+
+// Predicate is tested by If when it is run.
+type Predicate func() bool
+
+// If. Runs then if the predicate holds, and otherwise els (which may
+// be nil).
+
+type If struct {
+	predicate Predicate
+	then      Instruction
+	els       Instruction
+}
+
+func (s *Setup) If(predicate Predicate, then, els Instruction) *If {
+	return &If{
+		predicate: predicate,
+		then:      then,
+		els:       els,
+	}
+}
+
+func (i *If) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	instr, branch := i.then, "then"
+	if !i.predicate() {
+		instr, branch = i.els, "else"
+	}
+	l.SetPrefix(fmt.Sprintf("%s|%v(%s)", parentPrefix, i, branch))
+	if instr == nil {
+		return nil
+	}
+	if err := execInstruction(ctx, l, instr); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (i *If) String() string {
+	return "If"
+}
+
+func (i *If) Describe() string {
+	if i.els == nil {
+		return "If the predicate holds"
+	}
+	return "If the predicate holds, the first, otherwise the second"
+}
+
+func (i *If) Walk(fun func(Instruction)) {
+	fun(i.then)
+	if i.els != nil {
+		fun(i.els)
+	}
+}
+
+// Attempt. Runs the wrapped instruction and records whether it
+// succeeded, for later instructions to branch on with If. Other than
+// cancellation, its error is not passed on.
+
+type Attempt struct {
+	wrapped Instruction
+	lock    sync.Mutex
+	ran     bool
+	err     error
+}
+
+func (s *Setup) Attempt(instr Instruction) *Attempt {
+	return &Attempt{
+		wrapped: instr,
+	}
+}
+
+func (a *Attempt) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, a))
+	err := execInstruction(ctx, l, a.wrapped)
+	a.lock.Lock()
+	a.ran = true
+	a.err = err
+	a.lock.Unlock()
+	if err != nil {
+		l.Printf("Attempt failed: %v", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+	}
+	return nil
+}
+
+func (a *Attempt) String() string {
+	return "Attempt"
+}
+
+func (a *Attempt) Describe() string {
+	return "Attempt, recording the result of"
+}
+
+func (a *Attempt) Walk(fun func(Instruction)) {
+	fun(a.wrapped)
+}
+
+// Err is the error from the most recent run, if any.
+func (a *Attempt) Err() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.err
+}
+
+// Succeeded holds if the most recent run succeeded.
+func (a *Attempt) Succeeded() Predicate {
+	return func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.ran && a.err == nil
+	}
+}
+
+// Failed holds if the most recent run failed.
+func (a *Attempt) Failed() Predicate {
+	return func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.ran && a.err != nil
+	}
+}
+
+// Retry. Runs the wrapped instruction up to attempts times, until it
+// succeeds. The first retry is after backoff, and each subsequent
+// retry waits twice as long as the previous one. The error of the
+// last attempt is returned.
+
+type Retry struct {
+	wrapped  Instruction
+	attempts int
+	backoff  time.Duration
+}
+
+func (s *Setup) Retry(attempts int, backoff time.Duration, instr Instruction) *Retry {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &Retry{
+		wrapped:  instr,
+		attempts: attempts,
+		backoff:  backoff,
+	}
+}
+
+func (r *Retry) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	var err error
+	backoff := r.backoff
+	for idx := 0; idx < r.attempts; idx++ {
+		l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, r, idx))
+		if idx > 0 {
+			l.Printf("Retrying in %v", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff *= 2
+		}
+		if errCtx := ctx.Err(); errCtx != nil {
+			l.Printf("Error encountered: %v", errCtx)
+			return errCtx
+		}
+		if err = execInstruction(ctx, l, r.wrapped); err == nil {
+			return nil
+		}
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (r *Retry) String() string {
+	return fmt.Sprintf("Retry %v", r.attempts)
+}
+
+func (r *Retry) Describe() string {
+	return fmt.Sprintf("Try up to %d times, backing off from %v", r.attempts, r.backoff)
+}
+
+func (r *Retry) Walk(fun func(Instruction)) {
+	fun(r.wrapped)
+}
+
+// Named. Runs the wrapped instruction under a name of its own, in
+// log prefixes, error trees and dry runs. It is for building reusable
+// patterns out of other instructions.
+
+type Named struct {
+	name        string
+	description string
+	wrapped     Instruction
+}
+
+func (s *Setup) Named(name, description string, instr Instruction) *Named {
+	return &Named{
+		name:        name,
+		description: description,
+		wrapped:     instr,
+	}
+}
+
+func (n *Named) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, n))
+	if err := execInstruction(ctx, l, n.wrapped); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (n *Named) String() string {
+	return n.name
+}
+
+func (n *Named) Describe() string {
+	return n.description
+}
+
+func (n *Named) Walk(fun func(Instruction)) {
+	fun(n.wrapped)
+}
@@ -0,0 +1,158 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"testing"
+)
+
+// ran is an Instruction which records that it ran.
+type ran struct {
+	name   string
+	record *[]string
+}
+
+func (r ran) Exec(ctx context.Context, l *log.Logger) error {
+	*r.record = append(*r.record, r.name)
+	return nil
+}
+
+func (r ran) String() string {
+	return r.name
+}
+
+func TestPickWeighted(t *testing.T) {
+	cases := []struct {
+		weights  []uint
+		decision int64
+		picked   string
+	}{
+		{[]uint{1, 1}, 0, "0"},
+		{[]uint{1, 1}, 1, "1"},
+		{[]uint{1, 0, 2}, 0, "0"},
+		{[]uint{1, 0, 2}, 1, "2"},
+		{[]uint{1, 0, 2}, 2, "2"},
+		{[]uint{0, 3, 1}, 2, "1"},
+		{[]uint{0, 3, 1}, 3, "2"},
+		{[]uint{5}, 4, "0"},
+	}
+	for _, c := range cases {
+		s := NewSetup()
+		record := []string{}
+		choices := make([]WeightedChoice, len(c.weights))
+		for idx, weight := range c.weights {
+			choices[idx] = WeightedChoice{Weight: weight, Instruction: ran{name: fmt.Sprint(idx), record: &record}}
+		}
+		pw := s.PickWeighted(choices...)
+		script(s, pw, "", c.decision)
+		if err := pw.Exec(context.Background(), discardLogger()); err != nil {
+			t.Fatalf("Weights %v, decision %d: %v", c.weights, c.decision, err)
+		}
+		if len(record) != 1 || record[0] != c.picked {
+			t.Errorf("Weights %v, decision %d: ran %v; expected [%s]", c.weights, c.decision, record, c.picked)
+		}
+	}
+}
+
+func TestPickWeightedNoWeight(t *testing.T) {
+	for _, weights := range [][]uint{{}, {0}, {0, 0}} {
+		s := NewSetup()
+		record := []string{}
+		choices := make([]WeightedChoice, len(weights))
+		for idx, weight := range weights {
+			choices[idx] = WeightedChoice{Weight: weight, Instruction: ran{name: fmt.Sprint(idx), record: &record}}
+		}
+		if err := s.PickWeighted(choices...).Exec(context.Background(), discardLogger()); err == nil {
+			t.Errorf("Weights %v: expected an error", weights)
+		}
+		if len(record) != 0 {
+			t.Errorf("Weights %v: ran %v; expected nothing", weights, record)
+		}
+	}
+}
+
+func TestPickRMs(t *testing.T) {
+	cases := []struct {
+		min, max  int
+		decisions map[string]int
+		picked    []string
+	}{
+		{1, 1, map[string]int{"|count": 0, "|member(0)": 2}, []string{"c"}},
+		{2, 2, map[string]int{"|count": 0, "|member(0)": 3, "|member(1)": 0}, []string{"a", "d"}},
+		{1, 3, map[string]int{"|count": 2, "|member(0)": 1, "|member(1)": 1, "|member(2)": 1}, []string{"b", "c", "d"}},
+		{1, 3, map[string]int{"|count": 0, "|member(0)": 0}, []string{"a"}},
+		// Clamped to the number of RMs.
+		{0, 9, map[string]int{"|count": 3, "|member(0)": 0, "|member(1)": 0, "|member(2)": 0, "|member(3)": 0}, []string{"a", "b", "c", "d"}},
+	}
+	for _, c := range cases {
+		s := NewSetup()
+		rms := []*RM{}
+		for idx, name := range []string{"a", "b", "c", "d"} {
+			rms = append(rms, s.NewRM(name, uint16(10001+idx), nil, nil))
+		}
+		pr := s.PickRMs(rms, c.min, c.max, nil)
+		asked := []string{}
+		picked, err := pr.pick(func(suffix string, n int) int {
+			asked = append(asked, suffix)
+			return c.decisions[suffix]
+		})
+		if err != nil {
+			t.Fatalf("%d-%d, decisions %v: %v", c.min, c.max, c.decisions, err)
+		}
+		if names := rmNames(picked); fmt.Sprint(names) != fmt.Sprint(c.picked) {
+			t.Errorf("%d-%d, decisions %v: picked %v; expected %v", c.min, c.max, c.decisions, names, c.picked)
+		}
+		if len(asked) != len(c.decisions) {
+			t.Errorf("%d-%d, decisions %v: made decisions %v", c.min, c.max, c.decisions, asked)
+		}
+	}
+}
+
+func TestPickRMsTooFew(t *testing.T) {
+	s := NewSetup()
+	rms := []*RM{s.NewRM("a", 10001, nil, nil)}
+	for _, minMax := range [][2]int{{2, 2}, {2, 3}, {1, 0}} {
+		pr := s.PickRMs(rms, minMax[0], minMax[1], nil)
+		if _, err := pr.pick(func(string, int) int { return 0 }); err == nil {
+			t.Errorf("%d-%d of 1: expected an error", minMax[0], minMax[1])
+		}
+	}
+}
+
+// Every subset must be reachable, and replaying the recorded
+// decisions must pick the same RMs.
+func TestPickRMsReplay(t *testing.T) {
+	s := NewSetup()
+	s.SetSeed(1)
+	rms := []*RM{}
+	for idx, name := range []string{"a", "b", "c", "d", "e"} {
+		rms = append(rms, s.NewRM(name, uint16(10001+idx), nil, nil))
+	}
+	var picked []*RM
+	pr := s.PickRMs(rms, 1, 2, func(rms []*RM) Instruction {
+		picked = rms
+		return Program{}
+	})
+	seen := make(map[string]bool)
+	for idx := 0; idx < 500; idx++ {
+		if err := pr.Exec(context.Background(), discardLogger()); err != nil {
+			t.Fatal(err)
+		}
+		seen[fmt.Sprint(rmNames(picked))] = true
+	}
+	// 5 of size 1 and 10 of size 2.
+	if len(seen) != 15 {
+		t.Errorf("Picked %d distinct subsets; expected 15", len(seen))
+	}
+
+	script(s, pr, "|count", 1)
+	script(s, pr, "|member(0)", 4)
+	script(s, pr, "|member(1)", 1)
+	if err := pr.Exec(context.Background(), discardLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if names := fmt.Sprint(rmNames(picked)); names != "[b e]" {
+		t.Errorf("Replay picked %s; expected [b e]", names)
+	}
+}
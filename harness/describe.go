@@ -0,0 +1,113 @@
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Describer is implemented by instructions so that a program can be
+// shown without running it. Describe says, in one line, what the
+// instruction will do, including any durations and RM names.
+type Describer interface {
+	Describe() string
+}
+
+// Walker is implemented by instructions which run other
+// instructions. Walk calls fun on each of them, in order.
+type Walker interface {
+	Walk(fun func(Instruction))
+}
+
+// Describe returns the instruction's description, falling back to
+// its String.
+func Describe(instr Instruction) string {
+	if d, ok := instr.(Describer); ok {
+		return d.Describe()
+	}
+	return fmt.Sprint(instr)
+}
+
+// Walk calls fun on instr and then, depth first, on every instruction
+// beneath it. The depth of instr is 0.
+func Walk(instr Instruction, fun func(instr Instruction, depth int)) {
+	walk(instr, 0, fun)
+}
+
+func walk(instr Instruction, depth int, fun func(Instruction, int)) {
+	fun(instr, depth)
+	if w, ok := instr.(Walker); ok {
+		w.Walk(func(child Instruction) {
+			walk(child, depth+1, fun)
+		})
+	}
+}
+
+// DryRunFormat is how WriteDryRun renders a program.
+type DryRunFormat string
+
+const (
+	// DryRunText is an indented tree of descriptions.
+	DryRunText DryRunFormat = "text"
+	// DryRunDot is a Graphviz DOT digraph.
+	DryRunDot DryRunFormat = "dot"
+	// DryRunMermaid is a Mermaid flowchart.
+	DryRunMermaid DryRunFormat = "mermaid"
+)
+
+func ParseDryRunFormat(str string) (DryRunFormat, error) {
+	switch format := DryRunFormat(str); format {
+	case DryRunText, DryRunDot, DryRunMermaid:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Unknown dry run format: %s", str)
+	}
+}
+
+// WriteDryRun writes the instruction tree of prog to w, without
+// running any of it.
+func WriteDryRun(w io.Writer, prog Instruction, format DryRunFormat) error {
+	sb := new(strings.Builder)
+	switch format {
+	case DryRunText:
+		Walk(prog, func(instr Instruction, depth int) {
+			fmt.Fprintf(sb, "%s%s\n", strings.Repeat("  ", depth), Describe(instr))
+		})
+	case DryRunDot, DryRunMermaid:
+		dot := format == DryRunDot
+		if dot {
+			sb.WriteString("digraph program {\n\tnode [shape=box];\n")
+		} else {
+			sb.WriteString("flowchart TD\n")
+		}
+		// parents[depth] is the node id of the most recent
+		// instruction at that depth.
+		parents := []int{}
+		id := 0
+		Walk(prog, func(instr Instruction, depth int) {
+			parents = append(parents[:depth], id)
+			label := Describe(instr)
+			if dot {
+				fmt.Fprintf(sb, "\tn%d [label=%q];\n", id, label)
+			} else {
+				fmt.Fprintf(sb, "\tn%d[\"%s\"]\n", id, strings.Replace(label, "\"", "#quot;", -1))
+			}
+			if depth > 0 {
+				if dot {
+					fmt.Fprintf(sb, "\tn%d -> n%d;\n", parents[depth-1], id)
+				} else {
+					fmt.Fprintf(sb, "\tn%d --> n%d\n", parents[depth-1], id)
+				}
+			}
+			id++
+		})
+		if dot {
+			sb.WriteString("}\n")
+		}
+	default:
+		return errors.New("Unknown dry run format")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
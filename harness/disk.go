@@ -0,0 +1,413 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// RMFillDisk. Fills the filesystem holding the RM's data dir, leaving
+// only the given number of bytes free, by allocating a ballast file
+// next to the dir. The whole filesystem is filled, so FillDisk
+// refuses to run unless Setup.Dir is a filesystem of its own (e.g. a
+// small tmpfs mounted there) rather than part of one shared with
+// anything that matters. FreeDisk removes the ballast.
+
+type RMFillDisk struct {
+	*RM
+	leave uint64
+}
+
+func (rm *RM) FillDisk(leave uint64) *RMFillDisk {
+	return &RMFillDisk{
+		RM:    rm,
+		leave: leave,
+	}
+}
+
+func (rm *RM) ballastPath() string {
+	return filepath.Join(rm.setup.Dir.Path(), rm.name+".ballast")
+}
+
+func (rmfd *RMFillDisk) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmfd))
+
+	path := rmfd.ballastPath()
+	if err := ownFilesystem(filepath.Dir(path)); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(path), &stat); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	available := stat.Bavail * uint64(stat.Bsize)
+	if available <= rmfd.leave {
+		l.Printf("Only %d bytes free already", available)
+		return nil
+	}
+	size := int64(available - rmfd.leave)
+	l.Printf("Allocating %d bytes in %s...", size, path)
+	if err := allocate(ctx, path, size); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Allocating %d bytes in %s...done", size, path)
+	return nil
+}
+
+// ownFilesystem errors unless dir is the root of a filesystem, i.e.
+// it is on a different device to its parent.
+func ownFilesystem(dir string) error {
+	var dirStat, parentStat syscall.Stat_t
+	if err := syscall.Stat(dir, &dirStat); err != nil {
+		return err
+	}
+	if err := syscall.Stat(filepath.Join(dir, ".."), &parentStat); err != nil {
+		return err
+	}
+	if dirStat.Dev == parentStat.Dev {
+		return fmt.Errorf("Refusing to fill the filesystem holding %s, as it is not a filesystem of its own: mount a small tmpfs there and pass it as -dir", dir)
+	}
+	return nil
+}
+
+// allocate grows the file at path by size bytes. The space must
+// really be used, so a sparse file will not do: fallocate is used
+// where the filesystem supports it, and otherwise zeros are written.
+func allocate(ctx context.Context, path string, size int64) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if syscall.Fallocate(int(f.Fd()), 0, info.Size(), size) == nil {
+		return nil
+	}
+	zeros := make([]byte, 1024*1024)
+	for size > 0 {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		chunk := zeros
+		if size < int64(len(chunk)) {
+			chunk = chunk[:size]
+		}
+		n, err := f.Write(chunk)
+		size -= int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func (rmfd *RMFillDisk) String() string {
+	return fmt.Sprintf("FillDisk:%v", rmfd.name)
+}
+
+func (rmfd *RMFillDisk) Describe() string {
+	return fmt.Sprintf("Fill the disk of RM %s, leaving %d bytes free", rmfd.name, rmfd.leave)
+}
+
+// RMFreeDisk. Removes the ballast written by FillDisk, if any.
+
+type RMFreeDisk RM
+
+func (rm *RM) FreeDisk() *RMFreeDisk {
+	return (*RMFreeDisk)(rm)
+}
+
+func (rmfd *RMFreeDisk) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmfd))
+
+	path := (*RM)(rmfd).ballastPath()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Removed %s", path)
+	return nil
+}
+
+func (rmfd *RMFreeDisk) String() string {
+	return fmt.Sprintf("FreeDisk:%v", rmfd.name)
+}
+
+func (rmfd *RMFreeDisk) Describe() string {
+	return fmt.Sprintf("Free the disk of RM %s", rmfd.name)
+}
+
+// CorruptMode is how RMCorrupt damages a file.
+type CorruptMode string
+
+const (
+	// CorruptTruncate cuts the file short at a random length.
+	CorruptTruncate CorruptMode = "truncate"
+	// CorruptBitFlip flips one random bit of the file.
+	CorruptBitFlip CorruptMode = "bitflip"
+)
+
+func ParseCorruptMode(str string) (CorruptMode, error) {
+	switch mode := CorruptMode(str); mode {
+	case CorruptTruncate, CorruptBitFlip:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Unknown corruption mode: %s", str)
+	}
+}
+
+// RMCorrupt. Damages files in the data dir of a stopped RM: picks up
+// to the given number of distinct non-empty files at random (the
+// harness's own log files excluded) and truncates or bit-flips each.
+// The choices go through the Setup's decisions, so are replayable.
+
+type RMCorrupt struct {
+	*RM
+	mode  CorruptMode
+	files int
+}
+
+func (rm *RM) Corrupt(mode CorruptMode, files int) *RMCorrupt {
+	return &RMCorrupt{
+		RM:    rm,
+		mode:  mode,
+		files: files,
+	}
+}
+
+// harnessFiles are written into an RM's dir by the harness, not the
+// RM.
+var harnessFiles = map[string]bool{
+	"stdout.log":    true,
+	"stderr.log":    true,
+	"resources.csv": true,
+}
+
+func (rmc *RMCorrupt) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmc))
+
+	err := rmc.corrupt(l)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (rmc *RMCorrupt) corrupt(l *log.Logger) error {
+	if err := rmc.stopped(); err != nil {
+		return err
+	}
+	dir := rmc.Command.cwd.Path()
+	if len(dir) == 0 {
+		return fmt.Errorf("RM %s has never been started, so has no data", rmc.name)
+	}
+	candidates := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Size() > 0 && !harnessFiles[filepath.Base(path)] {
+			candidates = append(candidates, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("No data files found in %s", dir)
+	}
+	sort.Strings(candidates)
+
+	// Each decision has a prefix of its own, so that each is replayed.
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	for idx := 0; idx < rmc.files && len(candidates) > 0; idx++ {
+		filePrefix := fmt.Sprintf("%s(%d)", parentPrefix, idx)
+		l.SetPrefix(filePrefix + "|file")
+		picked := int(rmc.setup.decide(l, int64(len(candidates))))
+		path := candidates[picked]
+		candidates = append(candidates[:picked], candidates[picked+1:]...)
+		l.SetPrefix(filePrefix)
+		if err := rmc.corruptFile(l, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rmc *RMCorrupt) corruptFile(l *log.Logger, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	switch rmc.mode {
+	case CorruptTruncate:
+		l.SetPrefix(parentPrefix + "|offset")
+		length := rmc.setup.decide(l, size)
+		l.Printf("Truncating %s from %d to %d bytes", path, size, length)
+		return os.Truncate(path, length)
+	case CorruptBitFlip:
+		l.SetPrefix(parentPrefix + "|bit")
+		bit := rmc.setup.decide(l, size*8)
+		l.Printf("Flipping bit %d of byte %d of %s", bit%8, bit/8, path)
+		return flipBit(path, bit/8, byte(1)<<uint(bit%8))
+	default:
+		return fmt.Errorf("Unknown corruption mode: %s", rmc.mode)
+	}
+}
+
+func flipBit(path string, offset int64, mask byte) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	b := make([]byte, 1)
+	if _, err = f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return err
+	}
+	b[0] ^= mask
+	_, err = f.WriteAt(b, offset)
+	return err
+}
+
+func (rmc *RMCorrupt) String() string {
+	return fmt.Sprintf("Corrupt:%v", rmc.name)
+}
+
+func (rmc *RMCorrupt) Describe() string {
+	return fmt.Sprintf("Corrupt (%s) up to %d files of stopped RM %s", rmc.mode, rmc.files, rmc.name)
+}
+
+// RMExpectRecovery. Starts the RM and checks that, within the
+// timeout, it either recovers (a client can connect) or refuses to
+// start with a clear error: it exits with a non-zero status, without
+// panicking, having logged a line matching refusal. Hanging,
+// panicking, exiting with status 0 or exiting without logging the
+// refusal are failures, so refusal is required.
+
+type RMExpectRecovery struct {
+	*RM
+	timeout time.Duration
+	refusal *regexp.Regexp
+}
+
+func (rm *RM) ExpectRecovery(timeout time.Duration, refusal *regexp.Regexp) *RMExpectRecovery {
+	return &RMExpectRecovery{
+		RM:      rm,
+		timeout: timeout,
+		refusal: refusal,
+	}
+}
+
+func (rmer *RMExpectRecovery) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmer))
+
+	if rmer.refusal == nil {
+		err := fmt.Errorf("No refusal pattern given for RM %s", rmer.name)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	lw := rmer.watchers.add(rmer.refusal)
+	defer rmer.watchers.remove(lw)
+
+	if err := execInstruction(ctx, l, rmer.Start()); err != nil {
+		return err
+	}
+	_, exited := rmer.running()
+	host := rmer.Host()
+	th, _, err := rmer.setup.newTestHelper(l, []string{host})
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+
+	deadline := time.Now().Add(rmer.timeout)
+	l.Printf("Awaiting recovery or refusal of %s...", rmer.name)
+	for {
+		select {
+		case <-exited:
+			err = rmer.refused(ctx, l, lw)
+			if err != nil {
+				l.Printf("Error encountered: %v", err)
+			}
+			return err
+		default:
+		}
+		if err = (*RMAwaitReady)(rmer.RM).probe(ctx, host, th.ClientKeyPair, th.ClusterCert, deadline, exited); err == nil {
+			l.Printf("Awaiting recovery or refusal of %s...recovered", rmer.name)
+			return nil
+		} else if ctx.Err() != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		} else if time.Now().After(deadline) {
+			err = fmt.Errorf("RM %s neither recovered nor exited within %v: %v", rmer.name, rmer.timeout, err)
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-exited:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// refused checks how the RM exited, having not become ready.
+func (rmer *RMExpectRecovery) refused(ctx context.Context, l *log.Logger, lw *lineWatcher) error {
+	status, _ := rmer.wait(ctx)
+	if status == nil {
+		return ctx.Err()
+	}
+	if status.Panicked || status.Signal != 0 || status.Code == 0 {
+		return &UnexpectedExitError{Source: rmer.name, Status: status}
+	}
+	select {
+	case line := <-lw.matched:
+		l.Printf("Awaiting recovery or refusal of %s...refused (%v): %s", rmer.name, status, line)
+		return nil
+	default:
+		return fmt.Errorf("RM %s %v without a clear error (nothing matching /%v/)", rmer.name, status, lw.re)
+	}
+}
+
+func (rmer *RMExpectRecovery) String() string {
+	return fmt.Sprintf("ExpectRecovery:%v", rmer.name)
+}
+
+func (rmer *RMExpectRecovery) Describe() string {
+	return fmt.Sprintf("Start RM %s and expect it to recover or refuse to start within %v", rmer.name, rmer.timeout)
+}
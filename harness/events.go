@@ -0,0 +1,122 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event is a single structured record written to an EventSink as one
+// line of JSON.
+type Event struct {
+	Time        time.Time
+	Kind        EventKind
+	Path        string        `json:",omitempty"`
+	Instruction string        `json:",omitempty"`
+	Duration    time.Duration `json:",omitempty"`
+	Error       string        `json:",omitempty"`
+	Source      string        `json:",omitempty"`
+	Pid         int           `json:",omitempty"`
+	ExitCode    *int          `json:",omitempty"`
+	Signal      string        `json:",omitempty"`
+	Panicked    bool          `json:",omitempty"`
+	Stream      string        `json:",omitempty"`
+	Line        string        `json:",omitempty"`
+}
+
+type EventKind string
+
+const (
+	InstructionStart EventKind = "InstructionStart"
+	InstructionEnd   EventKind = "InstructionEnd"
+	ProcessStart     EventKind = "ProcessStart"
+	ProcessExit      EventKind = "ProcessExit"
+	ProcessOutput    EventKind = "ProcessOutput"
+)
+
+// EventSink writes Events as JSON lines. It is safe for concurrent
+// use.
+type EventSink struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewEventSink(w io.Writer) *EventSink {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &EventSink{encoder: encoder}
+}
+
+func (es *EventSink) Emit(e *Event) {
+	if es == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	es.encoder.Encode(e)
+}
+
+type eventSinkKey struct{}
+
+func withEventSink(ctx context.Context, es *EventSink) context.Context {
+	return context.WithValue(ctx, eventSinkKey{}, es)
+}
+
+func eventSink(ctx context.Context) *EventSink {
+	es, _ := ctx.Value(eventSinkKey{}).(*EventSink)
+	return es
+}
+
+// execInstruction runs instr, emitting InstructionStart and
+// InstructionEnd events if there is an EventSink in ctx, and wrapping
+// any error in an InstructionError. Composite instructions use this
+// to run their children.
+func execInstruction(ctx context.Context, l *log.Logger, instr Instruction) error {
+	es := eventSink(ctx)
+	path := l.Prefix()
+	name := fmt.Sprint(instr)
+	start := time.Now()
+	es.Emit(&Event{Time: start, Kind: InstructionStart, Path: path, Instruction: name})
+	err := instr.Exec(ctx, l)
+	end := time.Now()
+	if es != nil {
+		e := &Event{Time: end, Kind: InstructionEnd, Path: path, Instruction: name, Duration: end.Sub(start)}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		es.Emit(e)
+	}
+	if err != nil {
+		err = &InstructionError{
+			Path:        path,
+			Instruction: name,
+			Kind:        instructionKind(instr),
+			Start:       start,
+			End:         end,
+			Err:         err,
+		}
+	}
+	return err
+}
+
+func processExitEvent(source string, pid int, status *ExitStatus, err error) *Event {
+	e := &Event{Kind: ProcessExit, Source: source, Pid: pid, Panicked: status.Panicked}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if status.Code != -1 || status.Signal != 0 {
+		code := status.Code
+		e.ExitCode = &code
+	}
+	if status.Signal != 0 {
+		e.Signal = status.Signal.String()
+	}
+	return e
+}
@@ -0,0 +1,159 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExitStatus describes how a command's process ended.
+type ExitStatus struct {
+	// Code is the exit status, or -1 if the process was killed by a
+	// signal.
+	Code int
+	// Signal is the signal which killed the process, or 0.
+	Signal syscall.Signal
+	// Panicked is set if a Go panic or fatal runtime error was
+	// printed on stderr.
+	Panicked bool
+	// Runtime is how long the process ran for.
+	Runtime time.Duration
+}
+
+func newExitStatus(state *os.ProcessState, panicked bool, runtime time.Duration) *ExitStatus {
+	es := &ExitStatus{Code: -1, Panicked: panicked, Runtime: runtime}
+	if state != nil {
+		es.Code = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			es.Signal = status.Signal()
+		}
+	}
+	return es
+}
+
+// Clean is true if the process exited with status 0 and did not
+// panic.
+func (es *ExitStatus) Clean() bool {
+	return es.Code == 0 && es.Signal == 0 && !es.Panicked
+}
+
+func (es *ExitStatus) String() string {
+	var desc string
+	switch {
+	case es.Panicked:
+		desc = fmt.Sprintf("panicked (exit status %d)", es.Code)
+	case es.Signal != 0:
+		desc = fmt.Sprintf("killed by %v", es.Signal)
+	case es.Code != 0:
+		desc = fmt.Sprintf("exited with status %d", es.Code)
+	default:
+		desc = "exited cleanly"
+	}
+	return fmt.Sprintf("%s after %v", desc, es.Runtime)
+}
+
+// isPanicLine is true for the first line the Go runtime prints on
+// stderr for an unrecovered panic or a fatal error.
+func isPanicLine(line string) bool {
+	return strings.HasPrefix(line, "panic: ") || strings.HasPrefix(line, "fatal error: ")
+}
+
+// ExitStatus returns how the command's process most recently ended,
+// or nil if it has not yet ended.
+func (cmd *Command) ExitStatus() *ExitStatus {
+	cmd.exitLock.Lock()
+	defer cmd.exitLock.Unlock()
+	return cmd.exitStatus
+}
+
+// wait blocks until the process has exited and its output has been
+// drained, and then forgets about the process so it can be started
+// again. The error is that of exec.Cmd.Wait.
+func (cmd *Command) wait(ctx context.Context) (*ExitStatus, error) {
+	eCmd, exited := cmd.running()
+	if eCmd == nil {
+		return nil, errors.New("Process not running")
+	}
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	err := cmd.exitErr
+	cmd.stdout = nil
+	cmd.stderr = nil
+	cmd.readersWG = nil
+	cmd.exitErr = nil
+	cmd.exitLock.Lock()
+	defer cmd.exitLock.Unlock()
+	cmd.cmd = nil
+	cmd.exited = nil
+	return cmd.exitStatus, err
+}
+
+// UnexpectedExitError is returned by CommandExpectExit.
+type UnexpectedExitError struct {
+	Source string
+	Status *ExitStatus
+}
+
+func (uee *UnexpectedExitError) Error() string {
+	return fmt.Sprintf("%s %v unexpectedly", uee.Source, uee.Status)
+}
+
+// CommandExpectExit. Waits for the process to end, like Wait, and
+// then checks how it ended. If clean is set, it must have exited with
+// status 0 without panicking. Otherwise, any exit is accepted except
+// a panic: use this for processes which are being killed, or which
+// may shut themselves down, to still catch crashes.
+
+type CommandExpectExit struct {
+	*Command
+	clean bool
+}
+
+func (cmd *Command) ExpectExit(clean bool) *CommandExpectExit {
+	return &CommandExpectExit{
+		Command: cmd,
+		clean:   clean,
+	}
+}
+
+func (cmdee *CommandExpectExit) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmdee))
+	l.Print("Waiting for process end...")
+
+	status, err := cmdee.wait(ctx)
+	if status == nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	if status.Panicked || (cmdee.clean && !status.Clean()) {
+		err = &UnexpectedExitError{Source: cmdee.source(), Status: status}
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Waiting for process end...done: %v", status)
+	return nil
+}
+
+func (cmdee *CommandExpectExit) String() string {
+	if cmdee.clean {
+		return "ExpectExit:clean"
+	}
+	return "ExpectExit"
+}
+
+func (cmdee *CommandExpectExit) Describe() string {
+	if cmdee.clean {
+		return fmt.Sprintf("Wait for %s to exit cleanly", cmdee.source())
+	}
+	return fmt.Sprintf("Wait for %s to exit without panicking", cmdee.source())
+}
@@ -1,9 +1,13 @@
 package harness
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 )
 
 func Run(setup *Setup, prog Instruction) error {
@@ -14,12 +18,25 @@ func Run(setup *Setup, prog Instruction) error {
 		"GOSHAWKDB_CLUSTER_CERT",
 		"GOSHAWKDB_CLUSTER_KEYPAIR",
 		"GOSHAWKDB_ROOT_NAME",
+		"GOSHAWKDB_HARNESS_SEED",
+		"GOSHAWKDB_HARNESS_REPLAY",
+		"GOSHAWKDB_HARNESS_EVENTS",
+		"GOSHAWKDB_HARNESS_CLEANUP",
+		"GOSHAWKDB_HARNESS_DIR",
 		"GOPATH")
 
-	var binaryPath, certPath, configPath string
+	var binaryPath, certPath, configPath, seedStr, replayPath, eventsPath, cleanupStr, dirPath, dryRunFormat string
+	var dryRun bool
 	flag.StringVar(&binaryPath, "goshawkdb", "", "`Path` to GoshawkDB binary.")
 	flag.StringVar(&certPath, "cert", "", "`Path` to cluster certificate and key file.")
 	flag.StringVar(&configPath, "config", "", "`Path` to configuration file.")
+	flag.StringVar(&seedStr, "seed", "", "`Seed` for the harness's random decisions.")
+	flag.StringVar(&replayPath, "replay", "", "`Path` to replay file of decisions from a previous run.")
+	flag.StringVar(&eventsPath, "events", "", "`Path` to write structured events to as JSON lines (- for stdout).")
+	flag.StringVar(&cleanupStr, "cleanup", "", "What to do with the harness's dir at exit: `keep`, delete or archive (to the current dir).")
+	flag.StringVar(&dirPath, "dir", "", "`Path` to the harness's working dir (by default, a new temporary dir).")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the program's instructions instead of running them.")
+	flag.StringVar(&dryRunFormat, "dry-run-format", string(DryRunText), "`Format` for -dry-run: text, dot (Graphviz) or mermaid.")
 	flag.Parse()
 
 	if len(binaryPath) > 0 {
@@ -56,10 +73,119 @@ func Run(setup *Setup, prog Instruction) error {
 		}
 	}
 
+	if len(seedStr) == 0 {
+		seedStr = envMap["GOSHAWKDB_HARNESS_SEED"]
+	}
+	delete(envMap, "GOSHAWKDB_HARNESS_SEED")
+	if len(seedStr) > 0 {
+		seed, err := strconv.ParseInt(seedStr, 10, 64)
+		if err != nil {
+			return err
+		}
+		setup.SetSeed(seed)
+	}
+
+	if len(replayPath) == 0 {
+		replayPath = envMap["GOSHAWKDB_HARNESS_REPLAY"]
+	}
+	delete(envMap, "GOSHAWKDB_HARNESS_REPLAY")
+	if len(replayPath) > 0 {
+		if err := setup.LoadReplay(replayPath); err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		format, err := ParseDryRunFormat(dryRunFormat)
+		if err != nil {
+			return err
+		}
+		return WriteDryRun(os.Stdout, prog, format)
+	}
+
+	if len(eventsPath) == 0 {
+		eventsPath = envMap["GOSHAWKDB_HARNESS_EVENTS"]
+	}
+	delete(envMap, "GOSHAWKDB_HARNESS_EVENTS")
+	ctx := context.Background()
+	if eventsPath == "-" {
+		ctx = withEventSink(ctx, NewEventSink(os.Stdout))
+	} else if len(eventsPath) > 0 {
+		eventsFile, err := os.Create(eventsPath)
+		if err != nil {
+			return err
+		}
+		defer eventsFile.Close()
+		ctx = withEventSink(ctx, NewEventSink(eventsFile))
+	}
+
+	if len(cleanupStr) == 0 {
+		cleanupStr = envMap["GOSHAWKDB_HARNESS_CLEANUP"]
+	}
+	delete(envMap, "GOSHAWKDB_HARNESS_CLEANUP")
+	if len(cleanupStr) > 0 {
+		policy, err := ParseDirPolicy(cleanupStr)
+		if err != nil {
+			return err
+		}
+		setup.DirPolicy = policy
+	}
+
+	if len(dirPath) == 0 {
+		dirPath = envMap["GOSHAWKDB_HARNESS_DIR"]
+	}
+	delete(envMap, "GOSHAWKDB_HARNESS_DIR")
+	if len(dirPath) > 0 {
+		if err := setup.Dir.SetPath(dirPath, false); err != nil {
+			return err
+		}
+	}
+
 	setup.SetEnv(envMap)
 
 	l := setup.NewLogger()
-	return prog.Exec(l)
+
+	// On SIGINT or SIGTERM, cancel the program, so that it returns
+	// and everything gets cleaned up. If cleaning up takes too long, a
+	// second signal is raised again with the default handling, so
+	// ends the harness at once.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigs:
+			l.Printf("Received %v; stopping (again to exit immediately)", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			l.Printf("Received %v again; exiting without cleaning up", sig)
+			signal.Stop(sigs)
+			syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+		case <-done:
+		}
+	}()
+
+	err := func() (err error) {
+		// Deferred so that it happens even if the program panics.
+		defer func() {
+			if errCleanup := setup.Cleanup(l); errCleanup != nil && err == nil {
+				err = errCleanup
+			}
+		}()
+		return execInstruction(ctx, l, prog)
+	}()
+	if err != nil {
+		l.Printf("Errors encountered:\n%s", ErrorTree(err))
+	}
+	return err
 }
 
 func extractFromEnv(keys ...string) map[string]string {
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"goshawkdb.io/tests/atomicrw"
+	"goshawkdb.io/tests/banktransfer"
+	h "goshawkdb.io/tests/harness"
+	"goshawkdb.io/tests/parcount"
+	"goshawkdb.io/tests/simpleconflict"
+	"goshawkdb.io/tests/solocount"
+	"goshawkdb.io/tests/strongserializable"
+	"goshawkdb.io/tests/writeskew"
+	"log"
+	"os"
+)
+
+func init() {
+	h.RegisterWorkload("atomicrw", atomicrw.AtomicRW)
+	h.RegisterWorkload("banktransfer", banktransfer.BankTransfer)
+	h.RegisterWorkload("parcount", parcount.ParCount)
+	h.RegisterWorkload("simpleconflict", simpleconflict.SimpleConflict)
+	h.RegisterWorkload("solocount", solocount.SoloCount)
+	h.RegisterWorkload("strongserializable", strongserializable.StrongSerializable)
+	h.RegisterWorkload("writeskew", writeskew.WriteSkew)
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "run" {
+		fmt.Fprintf(os.Stderr, "Usage: %s run scenario.yaml [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	scenarioPath := os.Args[2]
+	os.Args = append(os.Args[:1], os.Args[3:]...)
+
+	setup := h.NewSetup()
+	prog, err := h.LoadScenario(setup, scenarioPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,8 +2,10 @@ package harness
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"goshawkdb.io/client"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,6 +13,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -18,28 +22,55 @@ import (
 )
 
 type Instruction interface {
-	Exec(*log.Logger) error
+	Exec(context.Context, *log.Logger) error
 }
 
 type Setup struct {
+	rngLock   sync.Mutex
 	rng       *rand.Rand
+	seed      int64
+	replay    map[string][]int64
+	recorder  *os.File
 	logOutput io.Writer
 	GosBin    *PathProvider
 	GosConfig *PathProvider
 	GosCert   *PathProvider
-	Dir       *PathProvider
+	Certs     *Certificates
+	// The client certificate used by workloads and other clients
+	// within the harness.
+	Client       *ClientCertificate
+	Dir          *PathProvider
+	ReadyTimeout time.Duration
+	// If set, the resource usage of every process started is sampled
+	// this often. See Command.Samples.
+	SampleInterval time.Duration
+	// How long Cleanup waits after SIGTERM before using SIGKILL.
+	StopGrace time.Duration
+	DirPolicy DirPolicy
+	// Where ArchiveDir writes archives to.
+	ArchiveTo string
+	processes *processTracker
 	env       []string
+	rms       []*RM
 }
 
 func NewSetup() *Setup {
-	return &Setup{
-		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
-		logOutput: os.Stdout,
-		GosBin:    &PathProvider{},
-		GosConfig: &PathProvider{},
-		GosCert:   &PathProvider{},
-		Dir:       &PathProvider{},
+	s := &Setup{
+		logOutput:    os.Stdout,
+		GosBin:       &PathProvider{},
+		GosConfig:    &PathProvider{},
+		GosCert:      &PathProvider{},
+		Certs:        &Certificates{},
+		Dir:          &PathProvider{},
+		ReadyTimeout: 30 * time.Second,
+		StopGrace:    10 * time.Second,
+		DirPolicy:    KeepDir,
+		ArchiveTo:    ".",
+		processes:    &processTracker{},
 	}
+	s.SetSeed(time.Now().UnixNano())
+	s.Client = s.NewClientCertificate("client")
+	return s
 }
 
 func (s *Setup) SetEnv(envMap map[string]string) {
@@ -58,10 +89,11 @@ func (s *Setup) cloneLogger(l *log.Logger, prefixExt string) *log.Logger {
 	return log.New(s.logOutput, fmt.Sprintf("%s|%s", l.Prefix(), prefixExt), l.Flags())
 }
 
-func (s *Setup) Exec(l *log.Logger) error {
+func (s *Setup) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, s))
+	l.Printf("Using seed %d", s.Seed())
 
 	if len(s.Dir.Path()) == 0 {
 		dir, err := ioutil.TempDir(os.TempDir(), "GoshawkDBHarness")
@@ -70,16 +102,33 @@ func (s *Setup) Exec(l *log.Logger) error {
 			return err
 		}
 		l.Printf("Created dir in %s", dir)
-		return s.Dir.SetPath(dir, false)
-	} else {
-		return s.Dir.EnsureDir()
+		if err = s.Dir.SetPath(dir, false); err != nil {
+			return err
+		}
+	} else if err := s.Dir.EnsureDir(); err != nil {
+		return err
 	}
+
+	if err := s.startRecording(); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	if err := s.initCertificates(l); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Recording decisions in %s", filepath.Join(s.Dir.Path(), replayFileName))
+	return nil
 }
 
 func (s *Setup) String() string {
 	return "Setup"
 }
 
+func (s *Setup) Describe() string {
+	return fmt.Sprintf("Setup: working dir, certificates, goshawkdb binary %s", describePath(s.GosBin))
+}
+
 // path provider
 
 type PathProvider struct {
@@ -140,7 +189,7 @@ func (pp *PathProvider) CopyTo(dir, receiver *PathProvider) Instruction {
 	}
 }
 
-func (pc *PathCopier) Exec(l *log.Logger) error {
+func (pc *PathCopier) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, pc))
@@ -170,28 +219,79 @@ func (pc *PathCopier) String() string {
 	return "PathCopier"
 }
 
+func (pc *PathCopier) Describe() string {
+	return fmt.Sprintf("Copy %s into %s", describePath(pc.src), describePath(pc.dest))
+}
+
+// describePath is for paths which may only be known once the program
+// is running.
+func describePath(pp *PathProvider) string {
+	if path := pp.Path(); len(path) > 0 {
+		return path
+	}
+	return "(set at run time)"
+}
+
 // Command
 
 type Command struct {
-	setup     *Setup
-	exePath   *PathProvider
-	args      []string
-	cwd       *PathProvider
-	env       []string
-	cmd       *exec.Cmd
-	stdout    io.ReadCloser
-	stderr    io.ReadCloser
-	readersWG *sync.WaitGroup
+	setup      *Setup
+	name       string
+	exePath    *PathProvider
+	args       []string
+	cwd        *PathProvider
+	env        []string
+	cmd        *exec.Cmd
+	stdout     io.ReadCloser
+	stderr     io.ReadCloser
+	readersWG  *sync.WaitGroup
+	exited     chan struct{}
+	exitErr    error
+	pid        int64
+	started    time.Time
+	panicked   int32
+	exitLock   sync.Mutex
+	exitStatus *ExitStatus
+	logFiles   bool
+	watchers   *lineWatchers
+	logMark    logMark
+	resources  resourceSamples
 }
 
 func (s *Setup) NewCmd(exePath *PathProvider, args []string, cwd *PathProvider, env []string) *Command {
 	return &Command{
-		setup:   s,
-		exePath: exePath,
-		args:    args,
-		cwd:     cwd,
-		env:     env,
+		setup:    s,
+		exePath:  exePath,
+		args:     args,
+		cwd:      cwd,
+		env:      env,
+		watchers: newLineWatchers(),
+	}
+}
+
+// source names the command in events: the RM name for RMs, otherwise
+// the executable.
+func (cmd *Command) source() string {
+	if len(cmd.name) > 0 {
+		return cmd.name
 	}
+	return filepath.Base(cmd.exePath.Path())
+}
+
+// Pid returns the process id of the running command, or 0 if it is
+// not running.
+func (cmd *Command) Pid() int {
+	return int(atomic.LoadInt64(&cmd.pid))
+}
+
+// running returns the command's process, and the channel closed once
+// it has exited, or nils if it has not been started (or has been
+// waited for). Like exitStatus, these are guarded by exitLock, as
+// they change on other goroutines.
+func (cmd *Command) running() (*exec.Cmd, chan struct{}) {
+	cmd.exitLock.Lock()
+	defer cmd.exitLock.Unlock()
+	return cmd.cmd, cmd.exited
 }
 
 // CommandStart. Does not block to wait for end of cmd
@@ -202,21 +302,40 @@ func (cmd *Command) Start() *CommandStart {
 	return (*CommandStart)(cmd)
 }
 
-func (cmd *CommandStart) Exec(l *log.Logger) error {
+func (cmd *CommandStart) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmd))
-	return cmd.start(l)
+	return cmd.start(ctx, l)
 }
 
-func (cmd *CommandStart) start(l *log.Logger) error {
+func (cmd *CommandStart) start(ctx context.Context, l *log.Logger) error {
 	eCmd := exec.Command(cmd.exePath.Path(), cmd.args...)
-	eCmd.Env = cmd.env
+	eCmd.Env = cmd.setup.childEnv(cmd.env)
 	if err := cmd.cwd.EnsureDir(); err != nil {
 		return err
 	}
 	eCmd.Dir = cmd.cwd.Path()
 
+	source := (*Command)(cmd).source()
+	es := eventSink(ctx)
+	stdoutStream := &outputStream{name: "StdOut", source: source, logger: cmd.setup.cloneLogger(l, "StdOut"), events: es}
+	stderrStream := &outputStream{name: "StdErr", source: source, logger: cmd.setup.cloneLogger(l, "StdErr"), events: es}
+	if cmd.logFiles {
+		if err := stdoutStream.openFile(cmd.cwd.Path()); err != nil {
+			return err
+		}
+		if err := stderrStream.openFile(cmd.cwd.Path()); err != nil {
+			stdoutStream.file.Close()
+			return err
+		}
+		if err := (*Command)(cmd).markLog(); err != nil {
+			stdoutStream.close()
+			stderrStream.close()
+			return err
+		}
+	}
+
 	killFun := func(err error) error {
 		if err == nil {
 			return nil
@@ -229,6 +348,8 @@ func (cmd *CommandStart) start(l *log.Logger) error {
 			if errkill != nil {
 				l.Printf("Supplementary error encountered when killing: %v", errkill)
 			}
+			stdoutStream.close()
+			stderrStream.close()
 			return err
 		}
 	}
@@ -246,26 +367,63 @@ func (cmd *CommandStart) start(l *log.Logger) error {
 		return err
 	}
 
+	exited := make(chan struct{})
+	cmd.exitLock.Lock()
 	cmd.cmd = eCmd
+	cmd.exited = exited
+	cmd.exitLock.Unlock()
 	cmd.stdout = stdout
 	cmd.stderr = stderr
 	cmd.readersWG = new(sync.WaitGroup)
 	cmd.readersWG.Add(2)
-	go cmd.reader(stdout, cmd.setup.cloneLogger(l, "StdOut"))
-	go cmd.reader(stderr, cmd.setup.cloneLogger(l, "StdErr"))
+	cmd.started = time.Now()
+	atomic.StoreInt32(&cmd.panicked, 0)
+	pid := eCmd.Process.Pid
+	es.Emit(&Event{Kind: ProcessStart, Path: l.Prefix(), Source: source, Pid: pid})
+	go cmd.reader(stdout, stdoutStream)
+	go cmd.reader(stderr, stderrStream)
+	atomic.StoreInt64(&cmd.pid, int64(pid))
+	go cmd.waiter(eCmd, cmd.readersWG, exited, es, source)
+	if interval := cmd.setup.SampleInterval; interval > 0 {
+		go (*Command)(cmd).sample(cmd.setup.cloneLogger(l, "Resources"), pid, interval, exited)
+	}
+	trackProcess(ctx, eCmd.Process, exited)
+	cmd.setup.processes.add(&trackedProcess{process: eCmd.Process, exited: exited})
 
 	return nil
 }
 
-func (cmd *CommandStart) reader(reader io.ReadCloser, l *log.Logger) {
+// waiter reaps the process once both readers have drained, so that
+// CommandWait (and anything else) can select on exited.
+func (cmd *CommandStart) waiter(eCmd *exec.Cmd, readersWG *sync.WaitGroup, exited chan struct{}, es *EventSink, source string) {
+	readersWG.Wait()
+	cmd.exitErr = eCmd.Wait()
+	status := newExitStatus(eCmd.ProcessState, atomic.LoadInt32(&cmd.panicked) != 0, time.Since(cmd.started))
+	cmd.exitLock.Lock()
+	cmd.exitStatus = status
+	cmd.exitLock.Unlock()
+	pid := eCmd.Process.Pid
+	atomic.CompareAndSwapInt64(&cmd.pid, int64(pid), 0)
+	es.Emit(processExitEvent(source, pid, status, cmd.exitErr))
+	close(exited)
+}
+
+func (cmd *CommandStart) reader(reader io.ReadCloser, stream *outputStream) {
 	defer cmd.readersWG.Done()
+	defer stream.close()
+	l := stream.logger
 	lineReader := bufio.NewReader(reader)
 	var err error
 	var line []byte
 	for err == nil {
 		line, err = lineReader.ReadBytes('\n')
 		if len(line) > 0 {
-			l.Printf("%s", string(line))
+			stream.write(line)
+			trimmed := strings.TrimRight(string(line), "\r\n")
+			if stream.name == "StdErr" && isPanicLine(trimmed) {
+				atomic.StoreInt32(&cmd.panicked, 1)
+			}
+			cmd.watchers.notify(trimmed)
 		}
 	}
 	if err != nil && err != io.EOF {
@@ -279,6 +437,10 @@ func (cmd *CommandStart) String() string {
 	return "CommandStart"
 }
 
+func (cmd *CommandStart) Describe() string {
+	return fmt.Sprintf("Start %s", (*Command)(cmd).source())
+}
+
 // CommandSignal
 
 type CommandSignal struct {
@@ -293,12 +455,18 @@ func (cmd *Command) Signal(sig os.Signal) *CommandSignal {
 	}
 }
 
-func (cmds *CommandSignal) Exec(l *log.Logger) error {
+func (cmds *CommandSignal) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmds))
 	l.Printf("Sending signal %v...", cmds.sig)
-	if err := cmds.cmd.Process.Signal(cmds.sig); err != nil {
+	eCmd, _ := cmds.running()
+	if eCmd == nil {
+		err := errors.New("Process not running")
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	if err := eCmd.Process.Signal(cmds.sig); err != nil {
 		l.Printf("Error encountered: %v", err)
 		return err
 	}
@@ -310,6 +478,10 @@ func (cmds *CommandSignal) String() string {
 	return "Signal"
 }
 
+func (cmds *CommandSignal) Describe() string {
+	return fmt.Sprintf("Send %v to %s", cmds.sig, cmds.source())
+}
+
 func (cmd *Command) Terminate() *CommandSignal {
 	return cmd.Signal(syscall.SIGTERM)
 }
@@ -318,6 +490,15 @@ func (cmd *Command) Kill() *CommandSignal {
 	return cmd.Signal(syscall.SIGKILL)
 }
 
+// Pause freezes the process (SIGSTOP) until it is resumed.
+func (cmd *Command) Pause() *CommandSignal {
+	return cmd.Signal(syscall.SIGSTOP)
+}
+
+func (cmd *Command) Resume() *CommandSignal {
+	return cmd.Signal(syscall.SIGCONT)
+}
+
 // CommandWait
 
 type CommandWait Command
@@ -326,20 +507,15 @@ func (cmd *Command) Wait() *CommandWait {
 	return (*CommandWait)(cmd)
 }
 
-func (cmdw *CommandWait) Exec(l *log.Logger) error {
+func (cmdw *CommandWait) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmdw))
 	l.Print("Waiting for process end...")
-	if err := cmdw.cmd.Wait(); err != nil {
+	if _, err := (*Command)(cmdw).wait(ctx); err != nil {
 		l.Printf("Error encountered: %v", err)
 		return err
 	}
-	cmdw.readersWG.Wait()
-	cmdw.cmd = nil
-	cmdw.stdout = nil
-	cmdw.stderr = nil
-	cmdw.readersWG = nil
 	l.Print("Waiting for process end...done")
 	return nil
 }
@@ -348,17 +524,24 @@ func (cmdw *CommandWait) String() string {
 	return "Wait"
 }
 
+func (cmdw *CommandWait) Describe() string {
+	return fmt.Sprintf("Wait for %s to exit", (*Command)(cmdw).source())
+}
+
 // RM
 
 type RM struct {
 	setup *Setup
 	*Command
-	name       string
-	port       uint16
-	certPath   *PathProvider
-	configPath *PathProvider
+	name        string
+	port        uint16
+	reservation *portReservation
+	certPath    *PathProvider
+	configPath  *PathProvider
 }
 
+// NewRM creates an RM. If port is 0, a free port is allocated: use
+// Port or Host to find out which.
 func (s *Setup) NewRM(name string, port uint16, certPath, configPath *PathProvider) *RM {
 	if certPath == nil {
 		certPath = s.GosCert
@@ -366,32 +549,52 @@ func (s *Setup) NewRM(name string, port uint16, certPath, configPath *PathProvid
 	if configPath == nil {
 		configPath = s.GosConfig
 	}
-	return &RM{
+	cmd := s.NewCmd(s.GosBin, nil, &PathProvider{}, nil)
+	cmd.name = name
+	cmd.logFiles = true
+	rm := &RM{
 		setup:      s,
-		Command:    s.NewCmd(s.GosBin, nil, &PathProvider{}, nil),
+		Command:    cmd,
 		name:       name,
 		port:       port,
 		certPath:   certPath,
 		configPath: configPath,
 	}
+	if port == 0 {
+		rm.port, rm.reservation = reservePort()
+	}
+	s.rms = append(s.rms, rm)
+	return rm
 }
 
 func (rm *RM) Start() *RMStart {
 	return (*RMStart)(rm)
 }
 
+func (rm *RM) Port() uint16 {
+	return rm.port
+}
+
+func (rm *RM) Host() string {
+	return fmt.Sprintf("localhost:%d", rm.port)
+}
+
+func (rm *RM) Name() string {
+	return rm.name
+}
+
 // RMStart
 
 type RMStart RM
 
-func (rms *RMStart) Exec(l *log.Logger) error {
+func (rms *RMStart) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rms))
 
 	if rms.Command.args == nil {
 		dirPP := rms.Command.cwd
-		err := dirPP.SetPath(filepath.Join(rms.setup.Dir.Path(), rms.name), false)
+		err := dirPP.SetPath((*RM)(rms).dataDir(), false)
 		if err != nil {
 			l.Printf("Error encountered: %v", err)
 			return err
@@ -411,13 +614,132 @@ func (rms *RMStart) Exec(l *log.Logger) error {
 		rms.Command.env = rms.setup.env
 	}
 
-	return rms.Command.Start().start(l)
+	if rms.exePath != rms.setup.GosBin {
+		l.Printf("Using binary %s", rms.exePath.Path())
+	}
+	// Hold on to the port for as long as possible.
+	if err := rms.reservation.release(); err != nil {
+		err = fmt.Errorf("Unable to allocate port for RM %s: %v", rms.name, err)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return rms.Command.Start().start(ctx, l)
 }
 
 func (rms *RMStart) String() string {
 	return fmt.Sprintf("RMStart:%v", rms.name)
 }
 
+func (rms *RMStart) Describe() string {
+	return fmt.Sprintf("Start RM %s on port %d", rms.name, rms.port)
+}
+
+// RMAwaitReady. Blocks until a client can connect to the RM, or
+// fails once Setup.ReadyTimeout has elapsed or as soon as the RM
+// exits.
+
+type RMAwaitReady RM
+
+func (rm *RM) AwaitReady() *RMAwaitReady {
+	return (*RMAwaitReady)(rm)
+}
+
+const readyPollInterval = 250 * time.Millisecond
+
+func (rmar *RMAwaitReady) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmar))
+
+	eCmd, exited := rmar.running()
+	if eCmd == nil {
+		err := fmt.Errorf("RM %s has not been started", rmar.name)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+
+	host := (*RM)(rmar).Host()
+	th, _, err := rmar.setup.newTestHelper(l, []string{host})
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+
+	timeout := rmar.setup.ReadyTimeout
+	deadline := time.Now().Add(timeout)
+	l.Printf("Awaiting client connection to %s...", host)
+	for {
+		if err = rmar.probe(ctx, th.ClusterHosts[0], th.ClientKeyPair, th.ClusterCert, deadline, exited); err == nil {
+			l.Printf("Awaiting client connection to %s...done", host)
+			return nil
+		} else if ctx.Err() != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		} else if err == errExitedBeforeReady {
+			err = fmt.Errorf("RM %s %v", rmar.name, err)
+			l.Printf("Error encountered: %v", err)
+			return err
+		} else if time.Now().After(deadline) {
+			err = fmt.Errorf("RM %s not ready after %v: %v", rmar.name, timeout, err)
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-exited:
+		case <-ctx.Done():
+		}
+	}
+}
+
+var (
+	errExitedBeforeReady = errors.New("exited before becoming ready")
+	errConnectTimeout    = errors.New("Timed out connecting")
+	errTransactTimeout   = errors.New("Timed out running transaction")
+)
+
+// probe makes and closes a connection to host. If it gives up
+// waiting, the connection is still closed should it be made later.
+func (rmar *RMAwaitReady) probe(ctx context.Context, host string, clientKeyPair, clusterCert []byte, deadline time.Time, exited chan struct{}) error {
+	type result struct {
+		conn *client.Connection
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		conn, err := client.NewConnection(host, clientKeyPair, clusterCert)
+		resultChan <- result{conn: conn, err: err}
+	}()
+	var err error
+	select {
+	case r := <-resultChan:
+		if r.err == nil {
+			r.conn.Shutdown()
+		}
+		return r.err
+	case <-time.After(deadline.Sub(time.Now())):
+		err = errConnectTimeout
+	case <-exited:
+		err = errExitedBeforeReady
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-resultChan; r.err == nil {
+			r.conn.Shutdown()
+		}
+	}()
+	return err
+}
+
+func (rmar *RMAwaitReady) String() string {
+	return fmt.Sprintf("RMAwaitReady:%v", rmar.name)
+}
+
+func (rmar *RMAwaitReady) Describe() string {
+	return fmt.Sprintf("Await RM %s ready, for up to %v", rmar.name, rmar.setup.ReadyTimeout)
+}
+
 // sleepy
 
 type Sleep struct {
@@ -441,16 +763,22 @@ func (s *Setup) SleepRandom(min, max time.Duration) *Sleep {
 	}
 }
 
-func (s *Sleep) Exec(l *log.Logger) error {
-	d := s.min
-	if diff := s.max - s.min; diff > 0 {
-		d = s.min + time.Duration(s.setup.rng.Int63n(int64(diff)))
-	}
+func (s *Sleep) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, s))
+	d := s.min
+	if diff := s.max - s.min; diff > 0 {
+		d = s.min + time.Duration(s.setup.decide(l, int64(diff)))
+	}
 	l.Printf("Sleeping for %v...", d)
-	time.Sleep(d)
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		err := ctx.Err()
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
 	l.Printf("Sleeping for %v...done", d)
 	return nil
 }
@@ -459,6 +787,53 @@ func (s Sleep) String() string {
 	return "Sleep"
 }
 
+func (s Sleep) Describe() string {
+	if s.min == s.max {
+		return fmt.Sprintf("Sleep %v", s.min)
+	}
+	return fmt.Sprintf("Sleep %v-%v", s.min, s.max)
+}
+
+// PauseFor. Freezes the RM for a random duration between min and max,
+// e.g. to emulate a long GC pause or VM freeze. The RM is always
+// resumed, even if the sleep is cancelled.
+
+type PauseFor struct {
+	rm    *RM
+	sleep *Sleep
+}
+
+func (s *Setup) PauseFor(rm *RM, min, max time.Duration) *PauseFor {
+	return &PauseFor{
+		rm:    rm,
+		sleep: s.SleepRandom(min, max),
+	}
+}
+
+func (pf *PauseFor) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, pf))
+
+	if err := pf.rm.Pause().Exec(ctx, l); err != nil {
+		return err
+	}
+	errSleep := pf.sleep.Exec(ctx, l)
+	// Must resume even if we've been cancelled.
+	if err := pf.rm.Resume().Exec(context.Background(), l); err != nil {
+		return err
+	}
+	return errSleep
+}
+
+func (pf *PauseFor) String() string {
+	return fmt.Sprintf("PauseFor:%v", pf.rm.name)
+}
+
+func (pf *PauseFor) Describe() string {
+	return fmt.Sprintf("Pause RM %s for %v-%v", pf.rm.name, pf.sleep.min, pf.sleep.max)
+}
+
 // absorbing errors
 
 type AbsorbError struct {
@@ -469,11 +844,11 @@ func (s *Setup) AbsorbError(instr Instruction) *AbsorbError {
 	return &AbsorbError{wrapped: instr}
 }
 
-func (ae AbsorbError) Exec(l *log.Logger) error {
+func (ae AbsorbError) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ae))
-	err := ae.wrapped.Exec(l)
+	err := execInstruction(ctx, l, ae.wrapped)
 	l.Printf("Absorbed: %v", err)
 	return nil
 }
@@ -482,16 +857,144 @@ func (ae AbsorbError) String() string {
 	return "AbsorbError"
 }
 
+func (ae AbsorbError) Describe() string {
+	return "Ignore errors from"
+}
+
+func (ae AbsorbError) Walk(fun func(Instruction)) {
+	fun(ae.wrapped)
+}
+
+// WithTimeout. Cancels the wrapped instruction if it has not
+// finished within the timeout, and kills any processes it started.
+
+type WithTimeout struct {
+	setup   *Setup
+	timeout time.Duration
+	wrapped Instruction
+}
+
+func (s *Setup) WithTimeout(d time.Duration, instr Instruction) *WithTimeout {
+	return &WithTimeout{
+		setup:   s,
+		timeout: d,
+		wrapped: instr,
+	}
+}
+
+func (wt *WithTimeout) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, wt))
+
+	parentCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, wt.timeout)
+	defer cancel()
+	ctx, tracker := withProcessTracker(ctx)
+
+	// The wrapped instruction gets its own logger: if it ignores
+	// cancellation it may well outlive us.
+	wrappedLogger := log.New(wt.setup.logOutput, l.Prefix(), l.Flags())
+	resultChan := make(chan error, 1)
+	go func() {
+		resultChan <- execInstruction(ctx, wrappedLogger, wt.wrapped)
+	}()
+
+	var err error
+	select {
+	case err = <-resultChan:
+		if err == nil {
+			return nil
+		}
+	case <-ctx.Done():
+		err = parentCtx.Err()
+	}
+	if ctx.Err() == context.DeadlineExceeded && parentCtx.Err() == nil {
+		tracker.kill(l)
+		err = &TimeoutError{Instruction: wt.wrapped, Timeout: wt.timeout}
+	}
+	l.Printf("Error encountered: %v", err)
+	return err
+}
+
+func (wt *WithTimeout) String() string {
+	return fmt.Sprintf("WithTimeout %v", wt.timeout)
+}
+
+func (wt *WithTimeout) Describe() string {
+	return fmt.Sprintf("Within %v", wt.timeout)
+}
+
+func (wt *WithTimeout) Walk(fun func(Instruction)) {
+	fun(wt.wrapped)
+}
+
+// process tracking. Processes started beneath a tracker are recorded
+// so that they can be killed if the tracker's owner gives up on them.
+
+type processTracker struct {
+	parent    *processTracker
+	lock      sync.Mutex
+	processes []*trackedProcess
+}
+
+type trackedProcess struct {
+	process *os.Process
+	exited  chan struct{}
+}
+
+type processTrackerKey struct{}
+
+func withProcessTracker(ctx context.Context) (context.Context, *processTracker) {
+	parent, _ := ctx.Value(processTrackerKey{}).(*processTracker)
+	tracker := &processTracker{parent: parent}
+	return context.WithValue(ctx, processTrackerKey{}, tracker), tracker
+}
+
+func trackProcess(ctx context.Context, process *os.Process, exited chan struct{}) {
+	tp := &trackedProcess{process: process, exited: exited}
+	tracker, _ := ctx.Value(processTrackerKey{}).(*processTracker)
+	for ; tracker != nil; tracker = tracker.parent {
+		tracker.add(tp)
+	}
+}
+
+func (pt *processTracker) add(tp *trackedProcess) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.processes = append(pt.processes, tp)
+}
+
+func (pt *processTracker) kill(l *log.Logger) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	for _, tp := range pt.processes {
+		select {
+		case <-tp.exited:
+			continue
+		default:
+		}
+		l.Printf("Killing process %v", tp.process.Pid)
+		if err := tp.process.Kill(); err != nil {
+			l.Printf("Supplementary error encountered when killing: %v", err)
+		}
+	}
+}
+
 // programs
 
 type Program []Instruction
 
-func (p Program) Exec(l *log.Logger) error {
+func (p Program) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	for idx, instr := range p {
 		l.SetPrefix(fmt.Sprintf("%s|Program(%d)", parentPrefix, idx))
-		if err := instr.Exec(l); err != nil {
+		if err := ctx.Err(); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		if err := execInstruction(ctx, l, instr); err != nil {
 			l.Printf("Error encountered: %v", err)
 			return err
 		}
@@ -503,6 +1006,16 @@ func (p Program) String() string {
 	return fmt.Sprintf("Program %v", len(p))
 }
 
+func (p Program) Describe() string {
+	return fmt.Sprintf("In sequence (%d)", len(p))
+}
+
+func (p Program) Walk(fun func(Instruction)) {
+	for _, instr := range p {
+		fun(instr)
+	}
+}
+
 // InParallel. This waits for the end of all of them
 
 type InParallel struct {
@@ -517,7 +1030,7 @@ func (s *Setup) InParallel(instrs ...Instruction) *InParallel {
 	}
 }
 
-func (ip *InParallel) Exec(l *log.Logger) error {
+func (ip *InParallel) Exec(ctx context.Context, l *log.Logger) error {
 	wg := new(sync.WaitGroup)
 	wg.Add(len(ip.instrs))
 	errChan := make(chan error, len(ip.instrs))
@@ -526,7 +1039,7 @@ func (ip *InParallel) Exec(l *log.Logger) error {
 		loggerClone := ip.setup.cloneLogger(l, fmt.Sprintf("InParallel(%d)", idx))
 		go func() {
 			defer wg.Done()
-			if err := instrCopy.Exec(loggerClone); err != nil {
+			if err := execInstruction(ctx, loggerClone, instrCopy); err != nil {
 				loggerClone.Printf("Error encountered: %v", err)
 				errChan <- err
 			}
@@ -549,6 +1062,16 @@ func (ip *InParallel) String() string {
 	return fmt.Sprintf("InParallel %v", len(ip.instrs))
 }
 
+func (ip *InParallel) Describe() string {
+	return fmt.Sprintf("In parallel (%d)", len(ip.instrs))
+}
+
+func (ip *InParallel) Walk(fun func(Instruction)) {
+	for _, instr := range ip.instrs {
+		fun(instr)
+	}
+}
+
 // UntilError
 
 type UntilError struct {
@@ -561,12 +1084,16 @@ func (s *Setup) UntilError(instr Instruction) Instruction {
 	}
 }
 
-func (ue *UntilError) Exec(l *log.Logger) error {
+func (ue *UntilError) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	for idx := 0; true; idx++ {
 		l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, ue, idx))
-		if err := ue.wrapped.Exec(l); err != nil {
+		if err := ctx.Err(); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		if err := execInstruction(ctx, l, ue.wrapped); err != nil {
 			l.Printf("Error encountered: %v", err)
 			return err
 		}
@@ -578,6 +1105,14 @@ func (ue *UntilError) String() string {
 	return "UntilError"
 }
 
+func (ue *UntilError) Describe() string {
+	return "Repeat until error"
+}
+
+func (ue *UntilError) Walk(fun func(Instruction)) {
+	fun(ue.wrapped)
+}
+
 // PickOne
 
 type PickOne struct {
@@ -592,13 +1127,14 @@ func (s *Setup) PickOne(instrs ...Instruction) *PickOne {
 	}
 }
 
-func (po *PickOne) Exec(l *log.Logger) error {
+func (po *PickOne) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
-	picked := po.setup.rng.Intn(len(po.instrs))
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, po))
+	picked := int(po.setup.decide(l, int64(len(po.instrs))))
 	instr := po.instrs[picked]
 	l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, po, picked))
-	if err := instr.Exec(l); err != nil {
+	if err := execInstruction(ctx, l, instr); err != nil {
 		l.Printf("Error encountered: %v", err)
 		return err
 	}
@@ -609,13 +1145,23 @@ func (po *PickOne) String() string {
 	return fmt.Sprintf("PickOne %v", len(po.instrs))
 }
 
+func (po *PickOne) Describe() string {
+	return fmt.Sprintf("Pick one of %d at random", len(po.instrs))
+}
+
+func (po *PickOne) Walk(fun func(Instruction)) {
+	for _, instr := range po.instrs {
+		fun(instr)
+	}
+}
+
 type LogMsg string
 
 func (s *Setup) Log(msg string) LogMsg {
 	return LogMsg(msg)
 }
 
-func (s LogMsg) Exec(l *log.Logger) error {
+func (s LogMsg) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, s))
@@ -627,6 +1173,10 @@ func (s LogMsg) String() string {
 	return "Log"
 }
 
+func (s LogMsg) Describe() string {
+	return fmt.Sprintf("Log %q", string(s))
+}
+
 // UntilStopped (also stops on error)
 
 type UntilStopped struct {
@@ -644,12 +1194,16 @@ func (s *Setup) UntilStopped(instr Instruction) *UntilStopped {
 	return us
 }
 
-func (us *UntilStopped) Exec(l *log.Logger) error {
+func (us *UntilStopped) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	for idx := 0; 0 == atomic.LoadUint32(&us.stopped); idx++ {
 		l.SetPrefix(fmt.Sprintf("%s|%v(%d)", parentPrefix, us, idx))
-		if err := us.wrapped.Exec(l); err != nil {
+		if err := ctx.Err(); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		if err := execInstruction(ctx, l, us.wrapped); err != nil {
 			l.Printf("Error encountered: %v", err)
 			return err
 		}
@@ -666,23 +1220,54 @@ func (us *UntilStopped) String() string {
 	return "UntilStopped"
 }
 
+func (us *UntilStopped) Describe() string {
+	return "Repeat until stopped or error"
+}
+
+func (us *UntilStopped) Walk(fun func(Instruction)) {
+	fun(us.wrapped)
+}
+
 type UntilStoppedStop UntilStopped
 
-func (uss *UntilStoppedStop) Exec(l *log.Logger) error {
+func (uss *UntilStoppedStop) Exec(ctx context.Context, l *log.Logger) error {
 	parentPrefix := l.Prefix()
 	defer l.SetPrefix(parentPrefix)
 	l.SetPrefix(fmt.Sprintf("%s|%v Stopping", parentPrefix, uss))
 	atomic.StoreUint32(&uss.stopped, 1)
-	<-uss.finished
-	return nil
+	select {
+	case <-uss.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (uss *UntilStoppedStop) String() string {
 	return "UntilStoppedStop"
 }
 
+func (uss *UntilStoppedStop) Describe() string {
+	return fmt.Sprintf("Stop repeating %s", Describe(uss.wrapped))
+}
+
 // errors
 
+// TimeoutError is returned by WithTimeout when the wrapped
+// instruction did not finish in time.
+type TimeoutError struct {
+	Instruction Instruction
+	Timeout     time.Duration
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v", te.Instruction, te.Timeout)
+}
+
+func (te *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
 type Errors []error
 
 func (e Errors) Error() string {
@@ -696,3 +1281,85 @@ func (e Errors) Error() string {
 		return str[1:]
 	}
 }
+
+// Is and As look through each of the errors in turn, so that
+// errors.Is and errors.As work on the errors from InParallel.
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// InstructionError records where in the program an error happened.
+// execInstruction wraps every error an instruction returns in one,
+// so an error from deep within a program is a chain of them, one per
+// level, ending in the original error. Error is that of the original
+// error; use ErrorTree to see the whole chain.
+type InstructionError struct {
+	// Path is the log prefix of the instruction's parent, e.g.
+	// |Program(4)|InParallel(2).
+	Path string
+	// Instruction is the instruction's String, and Kind its type.
+	Instruction string
+	Kind        string
+	Start, End  time.Time
+	Err         error
+}
+
+func (ie *InstructionError) Error() string {
+	return ie.Err.Error()
+}
+
+func (ie *InstructionError) Unwrap() error {
+	return ie.Err
+}
+
+func instructionKind(instr Instruction) string {
+	t := reflect.TypeOf(instr)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// ErrorTree renders err as an indented tree: an InstructionError
+// shows the instruction and when it ran, with its cause beneath;
+// Errors show each of their errors beneath each other.
+func ErrorTree(err error) string {
+	sb := new(strings.Builder)
+	writeErrorTree(sb, err, 0)
+	return sb.String()
+}
+
+func writeErrorTree(sb *strings.Builder, err error, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch e := err.(type) {
+	case *InstructionError:
+		at := ""
+		if len(e.Path) > 0 {
+			at = " at " + e.Path
+		}
+		fmt.Fprintf(sb, "%s%s (%s)%s, after %v\n", indent, e.Instruction, e.Kind, at, e.End.Sub(e.Start))
+		writeErrorTree(sb, e.Err, depth+1)
+	case Errors:
+		for _, err := range e {
+			writeErrorTree(sb, err, depth)
+		}
+	default:
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(sb, "%s%s\n", indent, line)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// fail is an Instruction which returns err.
+type fail struct {
+	err error
+}
+
+func (f fail) Exec(ctx context.Context, l *log.Logger) error {
+	return f.err
+}
+
+func (f fail) String() string {
+	return "fail"
+}
+
+var (
+	errA = errors.New("A went wrong")
+	errB = errors.New("B went wrong\nin two ways")
+)
+
+func instructionError(path, instr string, secs int, err error) *InstructionError {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &InstructionError{
+		Path:        path,
+		Instruction: instr,
+		Kind:        "Test",
+		Start:       start,
+		End:         start.Add(time.Duration(secs) * time.Second),
+		Err:         err,
+	}
+}
+
+func TestErrorTree(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		tree string
+	}{
+		{"plain", errA, "A went wrong\n"},
+		{"multiline", errB, "B went wrong\nin two ways\n"},
+		{"no path", instructionError("", "Program 1", 2, errA),
+			"Program 1 (Test), after 2s\n  A went wrong\n"},
+		{"nested", instructionError("", "Program 1", 3, instructionError("|Program(0)", "Sleep", 1, errB)),
+			"Program 1 (Test), after 3s\n" +
+				"  Sleep (Test) at |Program(0), after 1s\n" +
+				"    B went wrong\n" +
+				"    in two ways\n"},
+		{"parallel", instructionError("", "InParallel 2", 4, Errors{
+			instructionError("|InParallel(0)", "a", 1, errA),
+			instructionError("|InParallel(1)", "b", 2, &TimeoutError{Instruction: Program{}, Timeout: time.Second}),
+		}),
+			"InParallel 2 (Test), after 4s\n" +
+				"  a (Test) at |InParallel(0), after 1s\n" +
+				"    A went wrong\n" +
+				"  b (Test) at |InParallel(1), after 2s\n" +
+				"    Program 0 timed out after 1s\n"},
+	}
+	for _, c := range cases {
+		if tree := ErrorTree(c.err); tree != c.tree {
+			t.Errorf("%s: got\n%s\nexpected\n%s", c.name, tree, c.tree)
+		}
+	}
+}
+
+func TestErrorsIsAs(t *testing.T) {
+	timeout := &TimeoutError{Instruction: Program{}, Timeout: time.Second}
+	cases := []struct {
+		name      string
+		err       error
+		is        []error
+		isNot     []error
+		timeout   bool
+		instrPath string
+	}{
+		{"empty", Errors{}, nil, []error{errA}, false, ""},
+		{"plain", Errors{errA}, []error{errA}, []error{errB}, false, ""},
+		{"second", Errors{errB, errA}, []error{errA, errB}, nil, false, ""},
+		{"wrapped", Errors{instructionError("|p", "a", 1, errA)}, []error{errA}, []error{errB}, false, "|p"},
+		{"timeout", Errors{errB, instructionError("|q", "b", 1, timeout)},
+			[]error{errB, context.DeadlineExceeded}, []error{errA, context.Canceled}, true, "|q"},
+		{"nested", instructionError("|r", "c", 1, Errors{errB, Errors{fmt.Errorf("Wrapped: %w", timeout)}}),
+			[]error{errB, context.DeadlineExceeded}, []error{errA}, true, "|r"},
+	}
+	for _, c := range cases {
+		for _, target := range c.is {
+			if !errors.Is(c.err, target) {
+				t.Errorf("%s: expected errors.Is %q", c.name, target)
+			}
+		}
+		for _, target := range c.isNot {
+			if errors.Is(c.err, target) {
+				t.Errorf("%s: expected not errors.Is %q", c.name, target)
+			}
+		}
+		var te *TimeoutError
+		if found := errors.As(c.err, &te); found != c.timeout || (found && te != timeout) {
+			t.Errorf("%s: errors.As TimeoutError gave %v, %v", c.name, found, te)
+		}
+		var ie *InstructionError
+		if found := errors.As(c.err, &ie); found != (len(c.instrPath) > 0) || (found && ie.Path != c.instrPath) {
+			t.Errorf("%s: errors.As InstructionError gave %v, %v", c.name, found, ie)
+		}
+	}
+}
+
+// Errors from within a running program must keep their place in it.
+func TestInParallelErrors(t *testing.T) {
+	s := NewSetup()
+	s.logOutput = ioutil.Discard
+	record := []string{}
+	prog := Program{s.InParallel(ran{name: "a", record: &record}, fail{err: errA}, fail{err: errB})}
+	err := execInstruction(context.Background(), discardLogger(), prog)
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Fatalf("Got %v; expected both errors", err)
+	}
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Got %v; expected two errors from InParallel", err)
+	}
+	paths := map[string]bool{}
+	for _, err := range errs {
+		var ie *InstructionError
+		if !errors.As(err, &ie) || ie.Kind != "fail" {
+			t.Fatalf("Got %#v; expected an InstructionError from fail", err)
+		}
+		paths[ie.Path] = true
+	}
+	if !paths["|Program(0)|InParallel(1)"] || !paths["|Program(0)|InParallel(2)"] {
+		t.Errorf("Got paths %v", paths)
+	}
+	if len(record) != 1 {
+		t.Errorf("Ran %v; expected [a]", record)
+	}
+}
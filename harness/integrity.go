@@ -0,0 +1,256 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"goshawkdb.io/client"
+	"log"
+)
+
+// Integrity checks that data survives a change to the cluster. Seed
+// writes a known graph of objects off the "integrity" root object;
+// Verify later walks the graph from that root through each of a set
+// of RMs, and reports any missing objects, wrong values or broken
+// references.
+//
+// Object k of the graph references objects 2k+1 and 2k+2 (where they
+// exist), and also object k+1, so that the graph shares objects and
+// references can be checked for identity, not just value. Workloads
+// use the "test" root, so can run alongside without disturbing the
+// graph. Configs made by NewClusterConfig grant Setup.Client access
+// to both roots; a hand-written config must do likewise.
+type Integrity struct {
+	setup   *Setup
+	objects int
+}
+
+func (s *Setup) NewIntegrity(objects int) *Integrity {
+	if objects < 1 {
+		objects = 1
+	}
+	return &Integrity{
+		setup:   s,
+		objects: objects,
+	}
+}
+
+const (
+	integrityRootName  = "integrity"
+	integrityRootValue = "integrity"
+)
+
+func (i *Integrity) value(k int) []byte {
+	return []byte(fmt.Sprintf("integrity object %d of %d", k, i.objects))
+}
+
+func (i *Integrity) children(k int) []int {
+	children := []int{}
+	for _, c := range []int{2*k + 1, 2*k + 2, k + 1} {
+		if c < i.objects {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// transact runs fun in a transaction through the given RM. The
+// transaction cannot be interrupted, so if ctx is cancelled it is
+// abandoned.
+func (i *Integrity) transact(ctx context.Context, l *log.Logger, rm *RM, fun func(*client.Txn, client.ObjectRef) error) error {
+	th, _, err := i.setup.newTestHelper(l, []string{rm.Host()})
+	if err != nil {
+		return err
+	}
+	th.RootName = integrityRootName
+	resultChan := make(chan error, 1)
+	go func() {
+		conn, err := client.NewConnection(th.ClusterHosts[0], th.ClientKeyPair, th.ClusterCert)
+		if err != nil {
+			resultChan <- err
+			return
+		}
+		defer conn.Shutdown()
+		_, _, err = conn.RunTransaction(func(txn *client.Txn) (interface{}, error) {
+			root, err := th.GetRootObject(txn)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fun(txn, root)
+		})
+		resultChan <- err
+	}()
+	select {
+	case err = <-resultChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IntegritySeed. Writes the graph through the given RM.
+
+type IntegritySeed struct {
+	*Integrity
+	rm *RM
+}
+
+func (i *Integrity) Seed(rm *RM) *IntegritySeed {
+	return &IntegritySeed{
+		Integrity: i,
+		rm:        rm,
+	}
+}
+
+func (is *IntegritySeed) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, is))
+
+	l.Printf("Seeding %d objects through %s...", is.objects, is.rm.Host())
+	err := is.transact(ctx, l, is.rm, func(txn *client.Txn, root client.ObjectRef) error {
+		objs := make([]client.ObjectRef, is.objects)
+		// Children always have higher indices, so create from the end.
+		for k := is.objects - 1; k >= 0; k-- {
+			children := is.children(k)
+			refs := make([]client.ObjectRef, len(children))
+			for idx, c := range children {
+				refs[idx] = objs[c]
+			}
+			obj, err := txn.CreateObject(is.value(k), refs...)
+			if err != nil {
+				return err
+			}
+			objs[k] = obj
+		}
+		return root.Set([]byte(integrityRootValue), objs[0])
+	})
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Seeding %d objects through %s...done", is.objects, is.rm.Host())
+	return nil
+}
+
+func (is *IntegritySeed) String() string {
+	return fmt.Sprintf("IntegritySeed:%v", is.rm.name)
+}
+
+func (is *IntegritySeed) Describe() string {
+	return fmt.Sprintf("Seed %d objects through RM %s", is.objects, is.rm.name)
+}
+
+// IntegrityVerify. Walks the graph through each of the given RMs in
+// turn. All problems found are reported, as Errors.
+
+type IntegrityVerify struct {
+	*Integrity
+	rms []*RM
+}
+
+func (i *Integrity) Verify(rms ...*RM) *IntegrityVerify {
+	return &IntegrityVerify{
+		Integrity: i,
+		rms:       rms,
+	}
+}
+
+func (iv *IntegrityVerify) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, iv))
+
+	var errs Errors
+	for _, rm := range iv.rms {
+		l.Printf("Verifying %d objects through %s...", iv.objects, rm.Host())
+		var problems Errors
+		err := iv.transact(ctx, l, rm, func(txn *client.Txn, root client.ObjectRef) error {
+			// The transaction may be rerun, so start afresh each time.
+			var err error
+			problems, err = iv.walk(root)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("RM %s: %v", rm.name, err))
+		}
+		for _, problem := range problems {
+			errs = append(errs, fmt.Errorf("RM %s: %v", rm.name, problem))
+		}
+		if err == nil && len(problems) == 0 {
+			l.Printf("Verifying %d objects through %s...done", iv.objects, rm.Host())
+		}
+	}
+	if len(errs) != 0 {
+		l.Printf("Error encountered: %v", errs)
+		return errs
+	}
+	return nil
+}
+
+// walk returns the problems found with the graph. The error returned
+// is only for errors from the client (which may cause the transaction
+// to be retried).
+func (iv *IntegrityVerify) walk(root client.ObjectRef) (Errors, error) {
+	var problems Errors
+	value, err := root.Value()
+	if err != nil {
+		return nil, err
+	}
+	if string(value) != integrityRootValue {
+		problems = append(problems, fmt.Errorf("Root has value %q; expected %q", value, integrityRootValue))
+	}
+	refs, err := root.References()
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) != 1 {
+		return append(problems, fmt.Errorf("Root has %d references; expected 1", len(refs))), nil
+	}
+
+	found := make(map[int]client.ObjectRef, iv.objects)
+	found[0] = refs[0]
+	queue := []int{0}
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		obj := found[k]
+		value, err := obj.Value()
+		if err != nil {
+			return nil, err
+		}
+		if expected := iv.value(k); string(value) != string(expected) {
+			problems = append(problems, fmt.Errorf("Object %d has value %q; expected %q", k, value, expected))
+		}
+		refs, err := obj.References()
+		if err != nil {
+			return nil, err
+		}
+		children := iv.children(k)
+		if len(refs) != len(children) {
+			problems = append(problems, fmt.Errorf("Object %d has %d references; expected %d", k, len(refs), len(children)))
+		}
+		for idx, c := range children {
+			if idx >= len(refs) {
+				problems = append(problems, fmt.Errorf("Object %d is missing (no reference from object %d)", c, k))
+				continue
+			}
+			if existing, seen := found[c]; seen {
+				if !refs[idx].ReferencesSameAs(existing) {
+					problems = append(problems, fmt.Errorf("Reference %d of object %d does not refer to object %d", idx, k, c))
+				}
+				continue
+			}
+			found[c] = refs[idx]
+			queue = append(queue, c)
+		}
+	}
+	return problems, nil
+}
+
+func (iv *IntegrityVerify) String() string {
+	return fmt.Sprintf("IntegrityVerify:%v", rmNames(iv.rms))
+}
+
+func (iv *IntegrityVerify) Describe() string {
+	return fmt.Sprintf("Verify %d objects through RMs %v", iv.objects, rmNames(iv.rms))
+}
@@ -0,0 +1,279 @@
+package harness
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputStream is where each line of a process's stdout or stderr
+// goes: the harness log, the event sink, and (for RMs) a log file in
+// the RM's dir.
+type outputStream struct {
+	name   string
+	source string
+	logger *log.Logger
+	events *EventSink
+	file   *os.File
+}
+
+func (out *outputStream) openFile(dir string) error {
+	path := filepath.Join(dir, strings.ToLower(out.name)+".log")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	out.file = file
+	return nil
+}
+
+func (out *outputStream) write(line []byte) {
+	out.logger.Printf("%s", string(line))
+	out.events.Emit(&Event{Kind: ProcessOutput, Source: out.source, Stream: out.name, Line: strings.TrimRight(string(line), "\r\n")})
+	if out.file != nil {
+		if _, err := out.file.Write(line); err != nil {
+			out.logger.Printf("Error encountered writing to %s: %v", out.file.Name(), err)
+		}
+	}
+}
+
+func (out *outputStream) close() {
+	if out.file != nil {
+		out.file.Close()
+		out.file = nil
+	}
+}
+
+// lineWatchers are told about every line a command prints.
+
+type lineWatchers struct {
+	lock     sync.Mutex
+	watchers map[*lineWatcher]struct{}
+}
+
+type lineWatcher struct {
+	re      *regexp.Regexp
+	matched chan string
+}
+
+func newLineWatchers() *lineWatchers {
+	return &lineWatchers{watchers: make(map[*lineWatcher]struct{})}
+}
+
+func (lws *lineWatchers) add(re *regexp.Regexp) *lineWatcher {
+	lw := &lineWatcher{re: re, matched: make(chan string, 1)}
+	lws.lock.Lock()
+	lws.watchers[lw] = struct{}{}
+	lws.lock.Unlock()
+	return lw
+}
+
+func (lws *lineWatchers) remove(lw *lineWatcher) {
+	lws.lock.Lock()
+	delete(lws.watchers, lw)
+	lws.lock.Unlock()
+}
+
+func (lws *lineWatchers) notify(line string) {
+	lws.lock.Lock()
+	defer lws.lock.Unlock()
+	for lw := range lws.watchers {
+		if lw.re.MatchString(line) {
+			lw.matched <- line
+			delete(lws.watchers, lw)
+		}
+	}
+}
+
+// logMark is where in each of a command's log files ExpectLog starts
+// searching: where they ended when the command was last started, or
+// when MarkLog last ran.
+type logMark struct {
+	lock    sync.Mutex
+	offsets map[string]int64
+}
+
+var logFileNames = []string{"stdout.log", "stderr.log"}
+
+func (cmd *Command) markLog() error {
+	offsets := make(map[string]int64, len(logFileNames))
+	for _, name := range logFileNames {
+		info, err := os.Stat(filepath.Join(cmd.cwd.Path(), name))
+		if err == nil {
+			offsets[name] = info.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	cmd.logMark.lock.Lock()
+	cmd.logMark.offsets = offsets
+	cmd.logMark.lock.Unlock()
+	return nil
+}
+
+// searchLog returns the first line in the command's log files, after
+// the mark, which matches re.
+func (cmd *Command) searchLog(re *regexp.Regexp) (string, bool, error) {
+	cmd.logMark.lock.Lock()
+	offsets := cmd.logMark.offsets
+	cmd.logMark.lock.Unlock()
+	for _, name := range logFileNames {
+		line, found, err := searchFile(filepath.Join(cmd.cwd.Path(), name), offsets[name], re)
+		if err != nil || found {
+			return line, found, err
+		}
+	}
+	return "", false, nil
+}
+
+func searchFile(path string, offset int64, re *regexp.Regexp) (string, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if trimmed := strings.TrimRight(line, "\r\n"); re.MatchString(trimmed) {
+				return trimmed, true, nil
+			}
+		}
+		if err == io.EOF {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// CommandMarkLog. Records the current end of the command's log files
+// (so only for RMs), so that later ExpectLogs only consider lines
+// logged from now on.
+
+type CommandMarkLog Command
+
+func (cmd *Command) MarkLog() *CommandMarkLog {
+	return (*CommandMarkLog)(cmd)
+}
+
+func (cmdml *CommandMarkLog) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmdml))
+
+	cmd := (*Command)(cmdml)
+	var err error
+	if !cmd.logFiles {
+		err = fmt.Errorf("%s has no log files", cmd.source())
+	} else {
+		err = cmd.markLog()
+	}
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (cmdml *CommandMarkLog) String() string {
+	return "MarkLog"
+}
+
+func (cmdml *CommandMarkLog) Describe() string {
+	return fmt.Sprintf("Mark the log files of %s", (*Command)(cmdml).source())
+}
+
+// ExpectLog. Blocks until the command prints a line (on stdout or
+// stderr) matching the regexp. For RMs, the lines already in their
+// log files since they were last started (or since MarkLog) are
+// searched first, so ExpectLog can follow the instruction that causes
+// the line. For other commands, only lines printed after ExpectLog
+// starts are considered, so run them InParallel or put the ExpectLog
+// first. Fails if the timeout elapses or the process exits first.
+
+type ExpectLog struct {
+	*Command
+	re      *regexp.Regexp
+	timeout time.Duration
+}
+
+func (cmd *Command) ExpectLog(re *regexp.Regexp, timeout time.Duration) *ExpectLog {
+	return &ExpectLog{
+		Command: cmd,
+		re:      re,
+		timeout: timeout,
+	}
+}
+
+func (el *ExpectLog) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, el))
+
+	// Watch before searching the files, so no line can be missed
+	// between the two.
+	lw := el.watchers.add(el.re)
+	defer el.watchers.remove(lw)
+	l.Printf("Waiting for /%v/...", el.re)
+
+	if el.logFiles {
+		line, found, err := el.searchLog(el.re)
+		if err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		} else if found {
+			l.Printf("Waiting for /%v/...matched: %s", el.re, line)
+			return nil
+		}
+	}
+
+	eCmd, exited := el.running()
+	if eCmd == nil {
+		err := fmt.Errorf("%s is not running", el.source())
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+
+	var err error
+	select {
+	case line := <-lw.matched:
+		l.Printf("Waiting for /%v/...matched: %s", el.re, line)
+		return nil
+	case <-exited:
+		select {
+		case line := <-lw.matched:
+			l.Printf("Waiting for /%v/...matched: %s", el.re, line)
+			return nil
+		default:
+		}
+		err = fmt.Errorf("%s exited without logging /%v/", el.source(), el.re)
+	case <-time.After(el.timeout):
+		err = fmt.Errorf("%s did not log /%v/ within %v", el.source(), el.re, el.timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.Printf("Error encountered: %v", err)
+	return err
+}
+
+func (el *ExpectLog) String() string {
+	return fmt.Sprintf("ExpectLog:%v", el.source())
+}
+
+func (el *ExpectLog) Describe() string {
+	return fmt.Sprintf("Expect %s to log /%v/ within %v", el.source(), el.re, el.timeout)
+}
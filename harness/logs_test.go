@@ -0,0 +1,57 @@
+package harness
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ExpectLog runs alongside Wait, which forgets the process as soon as
+// it exits: run with -race.
+func TestExpectLogWhileWaiting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		pattern string
+		err     string
+	}{
+		{"ready", ""},
+		{"^rea", ""},
+		{"never", "without logging"},
+	}
+	for _, c := range cases {
+		s := NewSetup()
+		s.logOutput = ioutil.Discard
+		sh, err := NewPathProvider("sh", true)
+		if err != nil {
+			t.Skip(err)
+		}
+		cwd, err := NewPathProvider(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := s.NewCmd(sh, []string{"-c", "sleep 0.1; echo ready"}, cwd, nil)
+		l := discardLogger()
+		if err := cmd.Start().Exec(context.Background(), l); err != nil {
+			t.Fatal(err)
+		}
+		expect := cmd.ExpectLog(regexp.MustCompile(c.pattern), 5*time.Second)
+		err = s.InParallel(expect, cmd.Wait()).Exec(context.Background(), l)
+		switch {
+		case len(c.err) == 0 && err != nil:
+			t.Errorf("/%s/: %v", c.pattern, err)
+		case len(c.err) > 0 && err == nil:
+			t.Errorf("/%s/: expected an error", c.pattern)
+		case len(c.err) > 0 && !strings.Contains(err.Error(), c.err) && !strings.Contains(err.Error(), "is not running"):
+			t.Errorf("/%s/: got %v; expected %q", c.pattern, err, c.err)
+		}
+	}
+}
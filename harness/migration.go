@@ -0,0 +1,479 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"goshawkdb.io/client"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Topology is a cluster definition: which RMs form the cluster, and
+// how many failures it tolerates.
+type Topology struct {
+	RMs []*RM
+	F   uint8
+}
+
+func (t Topology) contains(rm *RM) bool {
+	for _, r := range t.RMs {
+		if r == rm {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the rms which are (or are not) in t.
+func (t Topology) filter(rms []*RM, in bool) []*RM {
+	result := []*RM{}
+	for _, rm := range rms {
+		if t.contains(rm) == in {
+			result = append(result, rm)
+		}
+	}
+	return result
+}
+
+// Migration drives a cluster from one Topology to another. Establish
+// writes the first config version and brings up the starting cluster.
+// Migrate writes the end config version, starts the RMs which are
+// added, sends SIGHUP to the RMs in SIGHUP, and then waits for the
+// cluster to converge before stopping the RMs which are removed.
+// Convergence is observed through the client API: see
+// MigrationAwaitConvergence. Teardown stops the end cluster. A
+// Migration is itself an Instruction which runs all three in turn; if
+// it has an Integrity, the Integrity is seeded through the starting
+// cluster before migrating, and verified through every RM of the end
+// cluster afterwards.
+//
+// Every RM involved must have been created with config.Path() as its
+// config path.
+type Migration struct {
+	setup  *Setup
+	config *ClusterConfig
+	from   Topology
+	to     Topology
+	// How long Migrate waits for the cluster to converge.
+	ConvergenceTimeout time.Duration
+	Integrity          *Integrity
+	// The RMs sent SIGHUP once the end config version is written. If
+	// nil, every RM retained from the starting topology is. Added RMs
+	// read the end version when they start; a running RM which is not
+	// sent SIGHUP carries on with the version it last read, just as if
+	// it had its own config file which was never updated.
+	SIGHUP []*RM
+}
+
+func (s *Setup) NewMigration(config *ClusterConfig, from, to Topology) *Migration {
+	return &Migration{
+		setup:              s,
+		config:             config,
+		from:               from,
+		to:                 to,
+		ConvergenceTimeout: 2 * time.Minute,
+	}
+}
+
+func (m *Migration) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, m))
+
+	if err := m.check(); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	return execInstruction(ctx, l, m.program())
+}
+
+func (m *Migration) program() Program {
+	prog := []Instruction{m.Establish()}
+	// Exec has checked there is an RM to seed through, but Walk
+	// must cope without one.
+	if m.Integrity != nil && len(m.from.RMs) > 0 {
+		prog = append(prog, m.Integrity.Seed(m.from.RMs[0]))
+	}
+	prog = append(prog, m.Migrate())
+	if m.Integrity != nil {
+		prog = append(prog, m.Integrity.Verify(m.to.RMs...))
+	}
+	prog = append(prog, m.Teardown())
+	return Program(prog)
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("Migration:%v", m.config.ClusterId)
+}
+
+func (m *Migration) Describe() string {
+	return fmt.Sprintf("Migrate cluster %s from %v (F=%d) to %v (F=%d)",
+		m.config.ClusterId, rmNames(m.from.RMs), m.from.F, rmNames(m.to.RMs), m.to.F)
+}
+
+func (m *Migration) Walk(fun func(Instruction)) {
+	m.program().Walk(fun)
+}
+
+// added, retained and removed partition the RMs of both topologies.
+func (m *Migration) added() []*RM {
+	return m.from.filter(m.to.RMs, false)
+}
+
+func (m *Migration) retained() []*RM {
+	return m.to.filter(m.from.RMs, true)
+}
+
+func (m *Migration) removed() []*RM {
+	return m.to.filter(m.from.RMs, false)
+}
+
+func (m *Migration) sighup() []*RM {
+	if m.SIGHUP == nil {
+		return m.retained()
+	}
+	return m.SIGHUP
+}
+
+func (m *Migration) check() error {
+	if len(m.from.RMs) == 0 || len(m.to.RMs) == 0 {
+		return errors.New("Both topologies must contain at least one RM")
+	}
+	if len(m.added()) == 0 && len(m.removed()) == 0 {
+		return errors.New("The topologies must differ in their RMs for convergence to be observed")
+	}
+	for _, t := range []Topology{m.from, m.to} {
+		for _, rm := range t.RMs {
+			if rm.configPath != m.config.Path() {
+				return fmt.Errorf("RM %s does not use the config of cluster %s", rm.name, m.config.ClusterId)
+			}
+		}
+	}
+	for _, rm := range m.SIGHUP {
+		if !m.from.contains(rm) {
+			return fmt.Errorf("RM %s is sent SIGHUP but is not in the starting topology", rm.name)
+		}
+	}
+	return nil
+}
+
+// forEach builds one instruction per RM, run in parallel.
+func (m *Migration) forEach(rms []*RM, fun func(*RM) Instruction) Instruction {
+	instrs := make([]Instruction, len(rms))
+	for idx, rm := range rms {
+		instrs[idx] = fun(rm)
+	}
+	return m.setup.InParallel(instrs...)
+}
+
+// Plan is the sequence of instructions Migrate runs.
+func (m *Migration) Plan() Program {
+	to := m.to
+	plan := []Instruction{
+		m.config.Update(func(cc *ClusterConfig) {
+			cc.RMs = to.RMs
+			cc.F = to.F
+		}),
+	}
+	if added := m.added(); len(added) > 0 {
+		plan = append(plan, m.forEach(added, func(rm *RM) Instruction { return rm.Start() }))
+	}
+	if sighup := m.sighup(); len(sighup) > 0 {
+		plan = append(plan, m.forEach(sighup, func(rm *RM) Instruction { return rm.Signal(syscall.SIGHUP) }))
+	}
+	if added := m.added(); len(added) > 0 {
+		plan = append(plan, m.forEach(added, func(rm *RM) Instruction { return rm.AwaitReady() }))
+	}
+	plan = append(plan, m.AwaitConvergence())
+	if removed := m.removed(); len(removed) > 0 {
+		// Removed RMs may already have shut themselves down, but
+		// must not have crashed.
+		plan = append(plan, m.forEach(removed, func(rm *RM) Instruction {
+			return Program([]Instruction{m.setup.AbsorbError(rm.Terminate()), rm.ExpectExit(false)})
+		}))
+	}
+	return Program(plan)
+}
+
+// MigrationEstablish
+
+type MigrationEstablish Migration
+
+func (m *Migration) Establish() *MigrationEstablish {
+	return (*MigrationEstablish)(m)
+}
+
+func (me *MigrationEstablish) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, me))
+
+	m := (*Migration)(me)
+	if err := m.check(); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Establishing %v with F=%d", rmNames(m.from.RMs), m.from.F)
+	return execInstruction(ctx, l, me.program())
+}
+
+func (me *MigrationEstablish) program() Program {
+	m := (*Migration)(me)
+	from := m.from
+	return Program([]Instruction{
+		m.config.Update(func(cc *ClusterConfig) {
+			cc.RMs = from.RMs
+			cc.F = from.F
+		}),
+		m.forEach(from.RMs, func(rm *RM) Instruction { return rm.Start() }),
+		m.forEach(from.RMs, func(rm *RM) Instruction { return rm.AwaitReady() }),
+	})
+}
+
+func (me *MigrationEstablish) String() string {
+	return "MigrationEstablish"
+}
+
+func (me *MigrationEstablish) Describe() string {
+	return fmt.Sprintf("Establish %v (F=%d)", rmNames(me.from.RMs), me.from.F)
+}
+
+func (me *MigrationEstablish) Walk(fun func(Instruction)) {
+	me.program().Walk(fun)
+}
+
+// MigrationMigrate
+
+type MigrationMigrate Migration
+
+func (m *Migration) Migrate() *MigrationMigrate {
+	return (*MigrationMigrate)(m)
+}
+
+func (mm *MigrationMigrate) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, mm))
+
+	m := (*Migration)(mm)
+	if err := m.check(); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Printf("Migrating from %v (F=%d) to %v (F=%d): starting %v, SIGHUP'ing %v, stopping %v",
+		rmNames(m.from.RMs), m.from.F, rmNames(m.to.RMs), m.to.F,
+		rmNames(m.added()), rmNames(m.sighup()), rmNames(m.removed()))
+	return execInstruction(ctx, l, m.Plan())
+}
+
+func (mm *MigrationMigrate) String() string {
+	return "MigrationMigrate"
+}
+
+func (mm *MigrationMigrate) Describe() string {
+	m := (*Migration)(mm)
+	return fmt.Sprintf("Start %v, SIGHUP %v, stop %v",
+		rmNames(m.added()), rmNames(m.sighup()), rmNames(m.removed()))
+}
+
+func (mm *MigrationMigrate) Walk(fun func(Instruction)) {
+	(*Migration)(mm).Plan().Walk(fun)
+}
+
+// MigrationTeardown. Terminates every RM of the end topology and
+// waits for them to exit.
+
+type MigrationTeardown Migration
+
+func (m *Migration) Teardown() *MigrationTeardown {
+	return (*MigrationTeardown)(m)
+}
+
+func (mt *MigrationTeardown) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, mt))
+
+	return execInstruction(ctx, l, mt.program())
+}
+
+func (mt *MigrationTeardown) program() Program {
+	m := (*Migration)(mt)
+	return Program([]Instruction{
+		m.forEach(m.to.RMs, func(rm *RM) Instruction { return rm.Terminate() }),
+		m.forEach(m.to.RMs, func(rm *RM) Instruction { return rm.Wait() }),
+	})
+}
+
+func (mt *MigrationTeardown) String() string {
+	return "MigrationTeardown"
+}
+
+func (mt *MigrationTeardown) Describe() string {
+	return fmt.Sprintf("Stop %v", rmNames(mt.to.RMs))
+}
+
+func (mt *MigrationTeardown) Walk(fun func(Instruction)) {
+	mt.program().Walk(fun)
+}
+
+// MigrationAwaitConvergence. Blocks until the cluster is seen,
+// through the client API, to have moved to the end topology, or fails
+// once ConvergenceTimeout has elapsed. Each added RM must commit a
+// transaction, which it cannot do until it has joined the cluster.
+// Each removed RM must stop serving clients: it exits, or connections
+// to it or transactions through it fail (timeouts don't count). Only
+// then must each retained RM commit a transaction, so that it is known
+// to serve clients after the change. A migration which neither adds
+// nor removes RMs shows clients no sign of converging, so check
+// refuses it.
+
+type MigrationAwaitConvergence Migration
+
+func (m *Migration) AwaitConvergence() *MigrationAwaitConvergence {
+	return (*MigrationAwaitConvergence)(m)
+}
+
+func (mac *MigrationAwaitConvergence) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, mac))
+
+	m := (*Migration)(mac)
+	if err := m.check(); err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	// Only the certificates are needed; each RM is probed in turn.
+	th, _, err := mac.setup.newTestHelper(l, nil)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	timeout := mac.ConvergenceTimeout
+	deadline := time.Now().Add(timeout)
+	await := func(rm *RM, serving bool) error {
+		if serving {
+			l.Printf("Awaiting transaction through %s...", rm.Host())
+		} else {
+			l.Printf("Awaiting %s no longer serving clients...", rm.Host())
+		}
+		for {
+			_, exited := rm.running()
+			err := mac.probe(ctx, rm.Host(), th.ClientKeyPair, th.ClusterCert, deadline, exited)
+			switch {
+			case serving && err == nil:
+				l.Printf("Awaiting transaction through %s...done", rm.Host())
+				return nil
+			case !serving && err != nil && err != errConnectTimeout && err != errTransactTimeout && ctx.Err() == nil:
+				l.Printf("Awaiting %s no longer serving clients...done: %v", rm.Host(), err)
+				return nil
+			case ctx.Err() != nil:
+				return ctx.Err()
+			case time.Now().After(deadline):
+				if err == nil {
+					err = errors.New("Still serving clients")
+				}
+				return fmt.Errorf("Cluster %s did not converge within %v: RM %s: %v", mac.config.ClusterId, timeout, rm.name, err)
+			}
+			select {
+			case <-time.After(readyPollInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+	for _, rm := range m.added() {
+		if err := await(rm, true); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	for _, rm := range m.removed() {
+		if err := await(rm, false); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	for _, rm := range m.retained() {
+		if err := await(rm, true); err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+var errExited = errors.New("Exited")
+
+// probe connects to host and runs a read of the roots, giving up at
+// the deadline or if exited closes. The connection is closed when
+// probe gives up, or when it is made, if that's later.
+func (mac *MigrationAwaitConvergence) probe(ctx context.Context, host string, clientKeyPair, clusterCert []byte, deadline time.Time, exited chan struct{}) error {
+	if exited == nil {
+		return errExited
+	}
+	type result struct {
+		conn *client.Connection
+		err  error
+	}
+	connChan := make(chan *client.Connection, 1)
+	resultChan := make(chan result, 1)
+	go func() {
+		conn, err := client.NewConnection(host, clientKeyPair, clusterCert)
+		if err != nil {
+			resultChan <- result{err: err}
+			return
+		}
+		connChan <- conn
+		_, _, err = conn.RunTransaction(func(txn *client.Txn) (interface{}, error) {
+			_, err := txn.GetRootObjects()
+			return nil, err
+		})
+		resultChan <- result{conn: conn, err: err}
+	}()
+	var err error
+	select {
+	case r := <-resultChan:
+		if r.conn != nil {
+			r.conn.Shutdown()
+		}
+		return r.err
+	case <-time.After(deadline.Sub(time.Now())):
+		err = errConnectTimeout
+	case <-exited:
+		err = errExited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	select {
+	case conn := <-connChan:
+		conn.Shutdown()
+		if err == errConnectTimeout {
+			err = errTransactTimeout
+		}
+	default:
+		go func() {
+			select {
+			case conn := <-connChan:
+				conn.Shutdown()
+			case r := <-resultChan:
+				if r.conn != nil {
+					r.conn.Shutdown()
+				}
+			}
+		}()
+	}
+	return err
+}
+
+func (mac *MigrationAwaitConvergence) String() string {
+	return "MigrationAwaitConvergence"
+}
+
+func (mac *MigrationAwaitConvergence) Describe() string {
+	m := (*Migration)(mac)
+	return fmt.Sprintf("Await %v serving clients, then %v not, then %v serving, for up to %v",
+		rmNames(m.added()), rmNames(m.removed()), rmNames(m.retained()), mac.ConvergenceTimeout)
+}
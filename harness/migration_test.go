@@ -0,0 +1,42 @@
+package harness
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationCheck(t *testing.T) {
+	s := NewSetup()
+	config := s.NewClusterConfig("c", 0, 5)
+	one := s.NewRM("one", 10001, nil, config.Path())
+	two := s.NewRM("two", 10002, nil, config.Path())
+	other := s.NewRM("other", 10003, nil, nil)
+
+	cases := []struct {
+		name     string
+		from, to []*RM
+		sighup   []*RM
+		err      string
+	}{
+		{name: "add", from: []*RM{one}, to: []*RM{one, two}},
+		{name: "remove", from: []*RM{one, two}, to: []*RM{one}, sighup: []*RM{two}},
+		{name: "replace", from: []*RM{one}, to: []*RM{two}},
+		{name: "from nothing", to: []*RM{one}, err: "at least one RM"},
+		{name: "to nothing", from: []*RM{one}, err: "at least one RM"},
+		{name: "same RMs", from: []*RM{one, two}, to: []*RM{two, one}, err: "must differ"},
+		{name: "other config", from: []*RM{one}, to: []*RM{one, other}, err: "does not use the config"},
+		{name: "SIGHUP an added RM", from: []*RM{one}, to: []*RM{one, two}, sighup: []*RM{two}, err: "not in the starting topology"},
+	}
+	for _, c := range cases {
+		m := s.NewMigration(config, Topology{RMs: c.from}, Topology{RMs: c.to})
+		m.SIGHUP = c.sighup
+		err := m.check()
+		if len(c.err) == 0 && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if len(c.err) > 0 && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: got error %v; expected %q", c.name, err, c.err)
+		}
+		// Describing a migration must not fail, even if running it would.
+		m.Walk(func(Instruction) {})
+	}
+}
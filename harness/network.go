@@ -0,0 +1,681 @@
+package harness
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network is a set of TCP proxies, one in front of each RM. Configs
+// passed through RewriteConfig list the proxy addresses rather than
+// the RMs' own ports, so all traffic between RMs flows through the
+// proxies where it can be partitioned, dropped or delayed.
+//
+// A proxy works out which RM a connection comes from by finding the
+// process which owns the other end of the socket in /proc, so this
+// only works on Linux. Connections from anything other than an RM in
+// the Network (e.g. clients) are never interfered with.
+type Network struct {
+	setup   *Setup
+	rms     []*RM
+	lock    sync.Mutex
+	proxies map[*RM]*proxy
+	rules   map[link]*linkRule
+}
+
+type link struct {
+	from, to *RM
+}
+
+type linkRule struct {
+	partitioned bool
+	drop        bool
+	min, max    time.Duration
+}
+
+func (s *Setup) NewNetwork(rms ...*RM) *Network {
+	return &Network{
+		setup:   s,
+		rms:     rms,
+		proxies: make(map[*RM]*proxy, len(rms)),
+		rules:   make(map[link]*linkRule),
+	}
+}
+
+func (n *Network) rule(from, to *RM) *linkRule {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if rule, found := n.rules[link{from: from, to: to}]; found {
+		ruleCopy := *rule
+		return &ruleCopy
+	}
+	return nil
+}
+
+// delay decides how long to hold a chunk of traffic. l's prefix
+// identifies the link, so that delays are recorded for replay.
+func (n *Network) delay(rule *linkRule, l *log.Logger) time.Duration {
+	d := rule.min
+	if diff := rule.max - rule.min; diff > 0 {
+		d += time.Duration(n.setup.decide(l, int64(diff)))
+	}
+	return d
+}
+
+func (n *Network) setRule(from, to *RM, fun func(*linkRule)) {
+	l := link{from: from, to: to}
+	rule, found := n.rules[l]
+	if !found {
+		rule = &linkRule{}
+		n.rules[l] = rule
+	}
+	fun(rule)
+}
+
+// NetworkStart. Starts a proxy for every RM in the Network. Must be
+// run before RewriteConfig.
+
+type NetworkStart Network
+
+func (n *Network) Start() *NetworkStart {
+	return (*NetworkStart)(n)
+}
+
+func (ns *NetworkStart) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ns))
+
+	n := (*Network)(ns)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, rm := range n.rms {
+		if _, found := n.proxies[rm]; found {
+			continue
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		p := &proxy{
+			network:  n,
+			rm:       rm,
+			listener: listener,
+			port:     uint16(listener.Addr().(*net.TCPAddr).Port),
+			conns:    make(map[*proxyConn]struct{}),
+		}
+		n.proxies[rm] = p
+		l.Printf("Proxying port %d to RM %s on port %d", p.port, rm.name, rm.port)
+		go p.accept(n.setup.cloneLogger(l, fmt.Sprintf("Proxy:%s", rm.name)))
+	}
+	return nil
+}
+
+func (ns *NetworkStart) String() string {
+	return "NetworkStart"
+}
+
+func (ns *NetworkStart) Describe() string {
+	return fmt.Sprintf("Start proxies for RMs %v", rmNames(ns.rms))
+}
+
+// NetworkStop. Closes all proxies and the connections through them.
+
+type NetworkStop Network
+
+func (n *Network) Stop() *NetworkStop {
+	return (*NetworkStop)(n)
+}
+
+func (ns *NetworkStop) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ns))
+
+	n := (*Network)(ns)
+	n.lock.Lock()
+	proxies := n.proxies
+	n.proxies = make(map[*RM]*proxy, len(n.rms))
+	n.lock.Unlock()
+	for _, p := range proxies {
+		p.close()
+	}
+	l.Printf("Closed %d proxies", len(proxies))
+	return nil
+}
+
+func (ns *NetworkStop) String() string {
+	return "NetworkStop"
+}
+
+func (ns *NetworkStop) Describe() string {
+	return fmt.Sprintf("Stop proxies for RMs %v", rmNames(ns.rms))
+}
+
+// NetworkRewriteConfig. Writes a copy of a config into Setup.Dir in
+// which every host that refers to an RM in the Network is replaced
+// by the address of that RM's proxy.
+
+type NetworkRewriteConfig struct {
+	*Network
+	src      *PathProvider
+	receiver *PathProvider
+}
+
+func (n *Network) RewriteConfig(src, receiver *PathProvider) *NetworkRewriteConfig {
+	return &NetworkRewriteConfig{
+		Network:  n,
+		src:      src,
+		receiver: receiver,
+	}
+}
+
+func (nrc *NetworkRewriteConfig) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, nrc))
+
+	src := nrc.src.Path()
+	dest := filepath.Join(nrc.setup.Dir.Path(), "proxied-"+filepath.Base(src))
+	l.Printf("Rewriting %v into %v", src, dest)
+	err := nrc.rewrite(src, dest)
+	if err == nil {
+		err = nrc.receiver.SetPath(dest, false)
+	}
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (nrc *NetworkRewriteConfig) rewrite(src, dest string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	if err = json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	hosts, ok := config["Hosts"].([]interface{})
+	if !ok {
+		return fmt.Errorf("No Hosts list found in %s", src)
+	}
+
+	nrc.lock.Lock()
+	ports := make(map[uint16]uint16, len(nrc.proxies))
+	for rm, p := range nrc.proxies {
+		ports[rm.port] = p.port
+	}
+	nrc.lock.Unlock()
+	if len(ports) == 0 {
+		return errors.New("Network has not been started")
+	}
+
+	for idx, host := range hosts {
+		hostStr, ok := host.(string)
+		if !ok {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(hostStr)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return err
+		}
+		if proxyPort, found := ports[uint16(port)]; found {
+			hosts[idx] = fmt.Sprintf("localhost:%d", proxyPort)
+		}
+	}
+
+	data, err = json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+func (nrc *NetworkRewriteConfig) String() string {
+	return "NetworkRewriteConfig"
+}
+
+func (nrc *NetworkRewriteConfig) Describe() string {
+	return fmt.Sprintf("Rewrite config %s to use proxies", describePath(nrc.src))
+}
+
+// NetworkPartition. RMs in different groups can no longer talk to
+// each other: existing connections between them are severed and new
+// ones refused. RMs not in any group are unaffected.
+
+type NetworkPartition struct {
+	*Network
+	groups [][]*RM
+}
+
+func (n *Network) Partition(groups ...[]*RM) *NetworkPartition {
+	return &NetworkPartition{
+		Network: n,
+		groups:  groups,
+	}
+}
+
+func (np *NetworkPartition) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, np))
+
+	np.lock.Lock()
+	for idxA, groupA := range np.groups {
+		for idxB, groupB := range np.groups {
+			if idxA == idxB {
+				continue
+			}
+			for _, from := range groupA {
+				for _, to := range groupB {
+					np.setRule(from, to, func(rule *linkRule) { rule.partitioned = true })
+				}
+			}
+		}
+	}
+	proxies := make([]*proxy, 0, len(np.proxies))
+	for _, p := range np.proxies {
+		proxies = append(proxies, p)
+	}
+	np.lock.Unlock()
+
+	severed := 0
+	for _, p := range proxies {
+		severed += p.sever()
+	}
+	l.Printf("Partitioned %v; severed %d connections", np.groupNames(), severed)
+	return nil
+}
+
+func (np *NetworkPartition) groupNames() [][]string {
+	names := make([][]string, len(np.groups))
+	for idx, group := range np.groups {
+		names[idx] = rmNames(group)
+	}
+	return names
+}
+
+func (np *NetworkPartition) String() string {
+	return fmt.Sprintf("NetworkPartition %v", np.groupNames())
+}
+
+func (np *NetworkPartition) Describe() string {
+	return fmt.Sprintf("Partition into %v", np.groupNames())
+}
+
+// NetworkFault. Drops or delays traffic sent from one set of RMs to
+// another. Bytes can't go missing from the middle of a TCP stream, so
+// dropped traffic is held rather than discarded: the proxy stops
+// reading from the sender, the connection stays open but goes
+// silent, and the held traffic is delivered once the fault is
+// removed. Delayed traffic is held for a random duration between min
+// and max: ordering within a connection is preserved (it's TCP) but
+// traffic on different connections gets reordered.
+
+type NetworkFault struct {
+	*Network
+	from, to []*RM
+	drop     bool
+	min, max time.Duration
+}
+
+func (n *Network) Drop(from, to []*RM) *NetworkFault {
+	return &NetworkFault{
+		Network: n,
+		from:    from,
+		to:      to,
+		drop:    true,
+	}
+}
+
+func (n *Network) Delay(from, to []*RM, min, max time.Duration) *NetworkFault {
+	return &NetworkFault{
+		Network: n,
+		from:    from,
+		to:      to,
+		min:     min,
+		max:     max,
+	}
+}
+
+// Reorder is Delay with no minimum: traffic between different pairs
+// of RMs arrives in a random order within the window.
+func (n *Network) Reorder(from, to []*RM, window time.Duration) *NetworkFault {
+	return n.Delay(from, to, 0, window)
+}
+
+func (nf *NetworkFault) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, nf))
+
+	nf.lock.Lock()
+	for _, from := range nf.from {
+		for _, to := range nf.to {
+			if from == to {
+				continue
+			}
+			nf.setRule(from, to, func(rule *linkRule) {
+				rule.drop = nf.drop
+				rule.min = nf.min
+				rule.max = nf.max
+			})
+		}
+	}
+	nf.lock.Unlock()
+	l.Printf("Applied from %v to %v", rmNames(nf.from), rmNames(nf.to))
+	return nil
+}
+
+func (nf *NetworkFault) String() string {
+	if nf.drop {
+		return "NetworkDrop"
+	}
+	return fmt.Sprintf("NetworkDelay %v-%v", nf.min, nf.max)
+}
+
+func (nf *NetworkFault) Describe() string {
+	if nf.drop {
+		return fmt.Sprintf("Drop traffic from %v to %v", rmNames(nf.from), rmNames(nf.to))
+	}
+	return fmt.Sprintf("Delay traffic from %v to %v by %v-%v", rmNames(nf.from), rmNames(nf.to), nf.min, nf.max)
+}
+
+// NetworkHeal. Removes all partitions and faults.
+
+type NetworkHeal Network
+
+func (n *Network) Heal() *NetworkHeal {
+	return (*NetworkHeal)(n)
+}
+
+func (nh *NetworkHeal) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, nh))
+
+	nh.lock.Lock()
+	nh.rules = make(map[link]*linkRule)
+	nh.lock.Unlock()
+	l.Print("Healed")
+	return nil
+}
+
+func (nh *NetworkHeal) String() string {
+	return "NetworkHeal"
+}
+
+func (nh *NetworkHeal) Describe() string {
+	return "Heal all partitions and faults"
+}
+
+func rmNames(rms []*RM) []string {
+	names := make([]string, len(rms))
+	for idx, rm := range rms {
+		names[idx] = rm.name
+	}
+	return names
+}
+
+// proxy
+
+type proxy struct {
+	network  *Network
+	rm       *RM
+	listener net.Listener
+	port     uint16
+	lock     sync.Mutex
+	conns    map[*proxyConn]struct{}
+}
+
+type proxyConn struct {
+	from       *RM
+	downstream net.Conn
+	upstream   net.Conn
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func (p *proxy) accept(l *log.Logger) {
+	for {
+		downstream, err := p.listener.Accept()
+		if err != nil {
+			l.Printf("Accept finished: %v", err)
+			return
+		}
+		go p.handle(downstream, l)
+	}
+}
+
+func (p *proxy) handle(downstream net.Conn, l *log.Logger) {
+	n := p.network
+	from := n.identify(downstream, p.port)
+	if from != nil {
+		if rule := n.rule(from, p.rm); rule != nil && rule.partitioned {
+			downstream.Close()
+			return
+		}
+	}
+	upstream, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", p.rm.port))
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		downstream.Close()
+		return
+	}
+	pc := &proxyConn{
+		from:       from,
+		downstream: downstream,
+		upstream:   upstream,
+		closed:     make(chan struct{}),
+	}
+	p.lock.Lock()
+	p.conns[pc] = struct{}{}
+	p.lock.Unlock()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go p.pump(pc, pc.downstream, pc.upstream, from, p.rm, wg, l)
+	go p.pump(pc, pc.upstream, pc.downstream, p.rm, from, wg, l)
+	wg.Wait()
+
+	p.lock.Lock()
+	delete(p.conns, pc)
+	p.lock.Unlock()
+}
+
+// How often a proxy holding dropped traffic checks whether the fault
+// has been removed.
+const proxyPollInterval = 10 * time.Millisecond
+
+type proxyChunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// pump copies from src to dest, applying the rule for the link on
+// every chunk read. A separate goroutine does the writing so that
+// delays don't throttle reading. Delays are decided under the path
+// of the proxy and the link, but not logged: there's one per chunk.
+func (p *proxy) pump(pc *proxyConn, src, dest net.Conn, from, to *RM, wg *sync.WaitGroup, l *log.Logger) {
+	defer wg.Done()
+	var decisions *log.Logger
+	if from != nil && to != nil {
+		decisions = log.New(ioutil.Discard, fmt.Sprintf("%s|%s->%s", l.Prefix(), from.name, to.name), 0)
+	}
+	chunks := make(chan *proxyChunk, 256)
+	go func() {
+		for chunk := range chunks {
+			if d := chunk.deliverAt.Sub(time.Now()); d > 0 {
+				time.Sleep(d)
+			}
+			if _, err := dest.Write(chunk.data); err != nil {
+				pc.close()
+			}
+		}
+	}()
+	defer close(chunks)
+
+	n := p.network
+	lastDeliverAt := time.Now()
+	buf := make([]byte, 16384)
+	for {
+		count, err := src.Read(buf)
+		if count > 0 {
+			rule, open := p.await(pc, from, to)
+			if !open {
+				pc.close()
+				return
+			}
+			deliverAt := time.Now()
+			if rule != nil {
+				deliverAt = deliverAt.Add(n.delay(rule, decisions))
+			}
+			if deliverAt.Before(lastDeliverAt) {
+				deliverAt = lastDeliverAt
+			}
+			lastDeliverAt = deliverAt
+			data := make([]byte, count)
+			copy(data, buf[:count])
+			chunks <- &proxyChunk{data: data, deliverAt: deliverAt}
+		}
+		if err != nil {
+			pc.close()
+			return
+		}
+	}
+}
+
+// await blocks while the link from from to to is dropping traffic.
+// It returns the rule then in force, or false if the link has been
+// partitioned or the connection closed meanwhile.
+func (p *proxy) await(pc *proxyConn, from, to *RM) (*linkRule, bool) {
+	if from == nil || to == nil {
+		return nil, true
+	}
+	for {
+		rule := p.network.rule(from, to)
+		switch {
+		case rule == nil:
+			return nil, true
+		case rule.partitioned:
+			return nil, false
+		case !rule.drop:
+			return rule, true
+		}
+		select {
+		case <-time.After(proxyPollInterval):
+		case <-pc.closed:
+			return nil, false
+		}
+	}
+}
+
+func (pc *proxyConn) close() {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.downstream.Close()
+		pc.upstream.Close()
+	})
+}
+
+// sever closes every connection through the proxy which is now
+// partitioned.
+func (p *proxy) sever() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	count := 0
+	for pc := range p.conns {
+		if pc.from == nil {
+			continue
+		}
+		if rule := p.network.rule(pc.from, p.rm); rule != nil && rule.partitioned {
+			pc.close()
+			count++
+		}
+	}
+	return count
+}
+
+func (p *proxy) close() {
+	p.listener.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for pc := range p.conns {
+		pc.close()
+	}
+}
+
+// identify finds which RM in the Network, if any, owns the other end
+// of conn.
+func (n *Network) identify(conn net.Conn, proxyPort uint16) *RM {
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	inode, err := socketInode(uint16(remote.Port), proxyPort)
+	if err != nil {
+		return nil
+	}
+	target := fmt.Sprintf("socket:[%s]", inode)
+	for _, rm := range n.rms {
+		pid := rm.Pid()
+		if pid == 0 {
+			continue
+		}
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if dest, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && dest == target {
+				return rm
+			}
+		}
+	}
+	return nil
+}
+
+// socketInode finds the inode of the TCP socket with the given local
+// and remote ports from /proc/net/tcp and /proc/net/tcp6.
+func socketInode(localPort, remotePort uint16) (string, error) {
+	local := fmt.Sprintf(":%04X", localPort)
+	remote := fmt.Sprintf(":%04X", remotePort)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if strings.HasSuffix(fields[1], local) && strings.HasSuffix(fields[2], remote) {
+				f.Close()
+				return fields[9], nil
+			}
+		}
+		f.Close()
+	}
+	return "", fmt.Errorf("No socket found from port %d to port %d", localPort, remotePort)
+}
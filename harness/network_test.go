@@ -0,0 +1,129 @@
+package harness
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echo serves connections on a loopback port by echoing back
+// whatever it reads.
+func echo(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+// exchange writes msg to conn and waits up to timeout for it to be
+// echoed back.
+func exchange(conn net.Conn, msg string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, err
+	}
+	return time.Now().Sub(start), nil
+}
+
+// The proxy identifies RMs through /proc, so the test process plays
+// RM a, connecting through b's proxy to an echo server standing in
+// for RM b.
+func TestNetwork(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Network proxies need /proc")
+	}
+	listener := echo(t)
+	defer listener.Close()
+
+	s := NewSetup()
+	s.logOutput = ioutil.Discard
+	a := s.NewRM("a", 10001, nil, nil)
+	b := s.NewRM("b", uint16(listener.Addr().(*net.TCPAddr).Port), nil, nil)
+	atomic.StoreInt64(&a.pid, int64(os.Getpid()))
+	n := s.NewNetwork(a, b)
+	l := discardLogger()
+	run := func(instr Instruction) {
+		if err := instr.Exec(context.Background(), l); err != nil {
+			t.Fatalf("%v: %v", instr, err)
+		}
+	}
+	run(n.Start())
+	defer n.Stop().Exec(context.Background(), l)
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", n.proxies[b].listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial()
+	defer conn.Close()
+	if _, err := exchange(conn, "hello", time.Second); err != nil {
+		t.Fatalf("Unable to talk through the proxy: %v", err)
+	}
+
+	run(n.Delay([]*RM{a}, []*RM{b}, 200*time.Millisecond, 200*time.Millisecond))
+	if elapsed, err := exchange(conn, "delayed", 2*time.Second); err != nil {
+		t.Fatalf("Delay: %v", err)
+	} else if elapsed < 200*time.Millisecond {
+		t.Errorf("Delay: echoed after %v; expected at least 200ms", elapsed)
+	}
+
+	// Dropped traffic is held, and delivered intact once healed.
+	run(n.Heal())
+	run(n.Drop([]*RM{a}, []*RM{b}))
+	if _, err := exchange(conn, "dropped", 200*time.Millisecond); err == nil {
+		t.Fatal("Drop: echoed; expected nothing")
+	}
+	run(n.Heal())
+	buf := make([]byte, len("dropped"))
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "dropped" {
+		t.Fatalf("Heal after drop: read %q, %v; expected the held traffic", buf, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Partitioning severs the existing connection and refuses new ones.
+	run(n.Partition([]*RM{a}, []*RM{b}))
+	if _, err := exchange(conn, "partitioned", time.Second); err == nil {
+		t.Error("Partition: existing connection still works")
+	}
+	refused := dial()
+	if _, err := exchange(refused, "partitioned", time.Second); err == nil {
+		t.Error("Partition: new connection works")
+	}
+	refused.Close()
+
+	run(n.Heal())
+	healed := dial()
+	defer healed.Close()
+	if _, err := exchange(healed, "healed", time.Second); err != nil {
+		t.Errorf("Heal after partition: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package harness
+
+import (
+	"net"
+	"sync"
+)
+
+// RMs created with port 0 are given a free port chosen by the
+// kernel. So that nothing else (such as another harness running
+// concurrently on the same machine) is given the same port, it stays
+// bound, on the loopback interface the harness connects to, by a
+// portReservation until immediately before the RM is first started.
+
+type portReservation struct {
+	lock     sync.Mutex
+	listener net.Listener
+	err      error
+}
+
+func reservePort() (uint16, *portReservation) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, &portReservation{err: err}
+	}
+	return uint16(listener.Addr().(*net.TCPAddr).Port), &portReservation{listener: listener}
+}
+
+// release frees the port so that the RM can bind it. It returns the
+// error, if any, from reserving the port in the first place.
+func (pr *portReservation) release() error {
+	if pr == nil {
+		return nil
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	if pr.listener != nil {
+		pr.listener.Close()
+		pr.listener = nil
+	}
+	return pr.err
+}
@@ -0,0 +1,117 @@
+package harness
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// Every random decision the harness makes (which branch PickOne
+// takes, how long a Sleep lasts) goes through Setup.decide. Decisions
+// are recorded in <Setup.Dir>/replay.jsonl, keyed by the path of the
+// instruction that made them. An instruction which runs more than
+// once under the same path (within Repeat or UntilStopped, say) makes
+// a sequence of decisions under that key, and they are replayed in
+// the same order. A recording can be loaded with LoadReplay to
+// reproduce exactly the same schedule, regardless of how the
+// goroutines of InParallel happen to interleave.
+
+const replayFileName = "replay.jsonl"
+
+type replayDecision struct {
+	Key   string
+	Value int64
+}
+
+func (s *Setup) Seed() int64 {
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	return s.seed
+}
+
+func (s *Setup) SetSeed(seed int64) {
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	s.seed = seed
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+// LoadReplay reads decisions previously recorded in a replay file.
+// Decisions found there are used instead of the random number
+// generator.
+func (s *Setup) LoadReplay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	replay := make(map[string][]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		decision := &replayDecision{}
+		if err := json.Unmarshal(scanner.Bytes(), decision); err != nil {
+			return fmt.Errorf("Unable to parse replay file %s: %v", path, err)
+		}
+		replay[decision.Key] = append(replay[decision.Key], decision.Value)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	s.replay = replay
+	return nil
+}
+
+// startRecording opens the replay file in Setup.Dir. Called from
+// Setup.Exec.
+func (s *Setup) startRecording() error {
+	f, err := os.Create(filepath.Join(s.Dir.Path(), replayFileName))
+	if err != nil {
+		return err
+	}
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	s.recorder = f
+	return nil
+}
+
+// decide returns a value in [0,n) for the decision identified by
+// the logger's current prefix, which is the path of the instruction
+// making the decision. When replaying, each decision takes the next
+// value recorded under its key.
+func (s *Setup) decide(l *log.Logger, n int64) int64 {
+	key := l.Prefix()
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	var value int64
+	queue := s.replay[key]
+	found := len(queue) > 0
+	if found {
+		value = queue[0]
+		s.replay[key] = queue[1:]
+	}
+	if found && value >= 0 && value < n {
+		l.Printf("Replaying decision %d", value)
+	} else {
+		if found {
+			l.Printf("Replayed decision %d out of range; ignoring", value)
+		} else if s.replay != nil {
+			l.Print("No decision to replay; using rng")
+		}
+		value = s.rng.Int63n(n)
+	}
+	if s.recorder != nil {
+		if data, err := json.Marshal(&replayDecision{Key: key, Value: value}); err == nil {
+			s.recorder.Write(append(data, '\n'))
+		}
+	}
+	return value
+}
@@ -0,0 +1,160 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// script queues values for s to replay for the decisions which instr
+// makes when run under a logger with no prefix. suffix picks out one
+// of several decisions instr makes.
+func script(s *Setup, instr interface{}, suffix string, values ...int64) {
+	if s.replay == nil {
+		s.replay = make(map[string][]int64)
+	}
+	key := fmt.Sprintf("|%v%s", instr, suffix)
+	s.replay[key] = append(s.replay[key], values...)
+}
+
+func TestLoadReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name    string
+		content string
+		replay  map[string][]int64
+	}{
+		{"empty", "", map[string][]int64{}},
+		{"one", `{"Key":"|a","Value":3}`, map[string][]int64{"|a": {3}}},
+		{"in order", `{"Key":"|a","Value":3}
+{"Key":"|b","Value":1}
+{"Key":"|a","Value":5}
+{"Key":"|a","Value":3}
+`, map[string][]int64{"|a": {3, 5, 3}, "|b": {1}}},
+		{"malformed", `{"Key":"|a","Value":3}
+{"Key":"|b","Value":
+`, nil},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, strings.Replace(c.name, " ", "_", -1))
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := NewSetup()
+		err := s.LoadReplay(path)
+		if c.replay == nil {
+			if err == nil || !strings.Contains(err.Error(), "Unable to parse replay file") {
+				t.Errorf("%s: got error %v", c.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(s.replay, c.replay) {
+			t.Errorf("%s: loaded %v; expected %v", c.name, s.replay, c.replay)
+		}
+	}
+}
+
+// Replayed values are used in order, skipping any out of range; once
+// they run out, the rng takes over.
+func TestDecideReplay(t *testing.T) {
+	const rng = -1
+	cases := []struct {
+		queue    []int64
+		n        int64
+		expected []int64
+	}{
+		{nil, 10, []int64{rng, rng}},
+		{[]int64{7}, 10, []int64{7, rng}},
+		{[]int64{0, 9, 4}, 10, []int64{0, 9, 4, rng}},
+		{[]int64{7, 10, -1, 3}, 10, []int64{7, rng, rng, 3}},
+		{[]int64{2, 2}, 3, []int64{2, 2}},
+	}
+	l := log.New(ioutil.Discard, "|key", 0)
+	for _, c := range cases {
+		s := NewSetup()
+		s.SetSeed(42)
+		s.replay = map[string][]int64{"|other": {1, 1, 1, 1}}
+		if c.queue != nil {
+			s.replay["|key"] = append([]int64{}, c.queue...)
+		}
+		reference := NewSetup()
+		reference.SetSeed(42)
+		decided := []int64{}
+		expected := []int64{}
+		for _, value := range c.expected {
+			if value == rng {
+				value = reference.rng.Int63n(c.n)
+			}
+			expected = append(expected, value)
+			decided = append(decided, s.decide(l, c.n))
+		}
+		if !reflect.DeepEqual(decided, expected) {
+			t.Errorf("Replaying %v in [0,%d): decided %v; expected %v", c.queue, c.n, decided, expected)
+		}
+	}
+}
+
+// A recording holds each decision under its key, and replaying it
+// under a different seed makes the same decisions, even when one key
+// makes several.
+func TestDecideRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []string{"|Repeat|PickOne", "|Repeat|Sleep", "|Repeat|PickOne", "|Repeat|PickOne"}
+	decide := func(s *Setup) []int64 {
+		values := []int64{}
+		for _, key := range keys {
+			values = append(values, s.decide(log.New(ioutil.Discard, key, 0), 1000))
+		}
+		return values
+	}
+
+	s := NewSetup()
+	s.SetSeed(1)
+	if err := s.Dir.SetPath(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.startRecording(); err != nil {
+		t.Fatal(err)
+	}
+	recorded := decide(s)
+	s.recorder.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, replayFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(keys) {
+		t.Fatalf("Recorded %q; expected %d decisions", lines, len(keys))
+	}
+	for idx, key := range keys {
+		if expected := fmt.Sprintf(`{"Key":"%s","Value":%d}`, key, recorded[idx]); lines[idx] != expected {
+			t.Errorf("Recorded %s; expected %s", lines[idx], expected)
+		}
+	}
+
+	r := NewSetup()
+	r.SetSeed(2)
+	if err := r.LoadReplay(filepath.Join(dir, replayFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if replayed := decide(r); !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("Replayed %v; expected %v", replayed, recorded)
+	}
+}
@@ -0,0 +1,254 @@
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceSample is a command's process's resource usage at one
+// moment, as read from /proc.
+type ResourceSample struct {
+	Time      time.Time
+	Pid       int
+	RSS       uint64 // bytes
+	CPUTime   time.Duration
+	Threads   int
+	OpenFiles int
+}
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat.
+// It is 100 on every Linux platform we run on.
+const clockTicks = 100
+
+func readResourceSample(pid int) (*ResourceSample, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	sample := &ResourceSample{Time: time.Now(), Pid: pid}
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The command name (field 2) may contain spaces, so start after
+	// its closing paren. fields[0] is then field 3 (state).
+	idx := strings.LastIndexByte(string(stat), ')')
+	if idx < 0 {
+		return nil, fmt.Errorf("Unable to parse %s/stat", dir)
+	}
+	fields := strings.Fields(string(stat[idx+1:]))
+	if len(fields) < 18 {
+		return nil, fmt.Errorf("Unable to parse %s/stat", dir)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sample.CPUTime = time.Duration(utime+stime) * time.Second / clockTicks
+	if sample.Threads, err = strconv.Atoi(fields[17]); err != nil {
+		return nil, err
+	}
+
+	status, err := ioutil.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") {
+			// e.g. "VmRSS:	  123456 kB"
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				kb, err := strconv.ParseUint(fields[1], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				sample.RSS = kb * 1024
+			}
+			break
+		}
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return nil, err
+	}
+	sample.OpenFiles = len(fds)
+	return sample, nil
+}
+
+type resourceSamples struct {
+	lock    sync.Mutex
+	samples []*ResourceSample
+}
+
+// Samples returns the resource samples taken of the command's most
+// recently started process. Sampling happens only if
+// Setup.SampleInterval is set.
+func (cmd *Command) Samples() []*ResourceSample {
+	cmd.resources.lock.Lock()
+	defer cmd.resources.lock.Unlock()
+	return append([]*ResourceSample{}, cmd.resources.samples...)
+}
+
+// sample runs until exited is closed, recording a sample every
+// interval. For commands with log files (i.e. RMs), samples are also
+// appended to resources.csv in the command's dir.
+func (cmd *Command) sample(l *log.Logger, pid int, interval time.Duration, exited chan struct{}) {
+	cmd.resources.lock.Lock()
+	cmd.resources.samples = nil
+	cmd.resources.lock.Unlock()
+
+	var file *os.File
+	if cmd.logFiles {
+		var err error
+		file, err = openResourcesFile(cmd.cwd.Path())
+		if err != nil {
+			l.Printf("Error encountered: %v", err)
+		} else {
+			defer file.Close()
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sample, err := readResourceSample(pid)
+		if err != nil {
+			// Most likely the process has just exited.
+			return
+		}
+		cmd.resources.lock.Lock()
+		cmd.resources.samples = append(cmd.resources.samples, sample)
+		cmd.resources.lock.Unlock()
+		if file != nil {
+			fmt.Fprintf(file, "%s,%d,%d,%.2f,%d,%d\n", sample.Time.Format(time.RFC3339Nano), sample.Pid,
+				sample.RSS, sample.CPUTime.Seconds(), sample.Threads, sample.OpenFiles)
+		}
+		select {
+		case <-ticker.C:
+		case <-exited:
+			return
+		}
+	}
+}
+
+func openResourcesFile(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, "resources.csv"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		file.WriteString("time,pid,rssBytes,cpuSeconds,threads,openFiles\n")
+	}
+	return file, nil
+}
+
+// ResourceBounds are limits on a command's resource usage. Zero
+// values are not checked.
+type ResourceBounds struct {
+	MaxRSS       uint64 // bytes
+	MaxThreads   int
+	MaxOpenFiles int
+	// MaxRSSGrowth is the largest allowed increase in RSS, as a
+	// percentage of the RSS once Warmup has passed since the process
+	// started.
+	MaxRSSGrowth float64
+	Warmup       time.Duration
+}
+
+// CommandExpectResources. Checks the samples taken so far of the
+// command's process against the bounds. All violations are reported,
+// as Errors.
+
+type CommandExpectResources struct {
+	*Command
+	bounds ResourceBounds
+}
+
+func (cmd *Command) ExpectResources(bounds ResourceBounds) *CommandExpectResources {
+	return &CommandExpectResources{
+		Command: cmd,
+		bounds:  bounds,
+	}
+}
+
+func (cmder *CommandExpectResources) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cmder))
+
+	samples := cmder.Samples()
+	if len(samples) == 0 {
+		err := fmt.Errorf("No resource samples of %s: is Setup.SampleInterval set?", cmder.source())
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	bounds := cmder.bounds
+	first := samples[0]
+	// Only the worst sample for each bound is reported.
+	maxRSS, maxThreads, maxOpenFiles := first, first, first
+	var baseline, peak *ResourceSample
+	for _, sample := range samples {
+		if sample.RSS > maxRSS.RSS {
+			maxRSS = sample
+		}
+		if sample.Threads > maxThreads.Threads {
+			maxThreads = sample
+		}
+		if sample.OpenFiles > maxOpenFiles.OpenFiles {
+			maxOpenFiles = sample
+		}
+		if baseline == nil && sample.Time.Sub(first.Time) >= bounds.Warmup {
+			baseline = sample
+		}
+		if baseline != nil && (peak == nil || sample.RSS > peak.RSS) {
+			peak = sample
+		}
+	}
+	var errs Errors
+	if bounds.MaxRSS > 0 && maxRSS.RSS > bounds.MaxRSS {
+		errs = append(errs, fmt.Errorf("RSS of %d bytes after %v exceeds %d", maxRSS.RSS, maxRSS.Time.Sub(first.Time), bounds.MaxRSS))
+	}
+	if bounds.MaxThreads > 0 && maxThreads.Threads > bounds.MaxThreads {
+		errs = append(errs, fmt.Errorf("%d threads after %v exceeds %d", maxThreads.Threads, maxThreads.Time.Sub(first.Time), bounds.MaxThreads))
+	}
+	if bounds.MaxOpenFiles > 0 && maxOpenFiles.OpenFiles > bounds.MaxOpenFiles {
+		errs = append(errs, fmt.Errorf("%d open files after %v exceeds %d", maxOpenFiles.OpenFiles, maxOpenFiles.Time.Sub(first.Time), bounds.MaxOpenFiles))
+	}
+	if bounds.MaxRSSGrowth > 0 {
+		if baseline == nil || baseline.RSS == 0 {
+			errs = append(errs, errors.New("No samples after warmup to measure RSS growth from"))
+		} else if growth := 100 * (float64(peak.RSS) - float64(baseline.RSS)) / float64(baseline.RSS); growth > bounds.MaxRSSGrowth {
+			errs = append(errs, fmt.Errorf("RSS grew %.1f%% (from %d to %d bytes), exceeding %.1f%%", growth, baseline.RSS, peak.RSS, bounds.MaxRSSGrowth))
+		}
+	}
+	if len(errs) != 0 {
+		for idx, err := range errs {
+			errs[idx] = fmt.Errorf("%s: %v", cmder.source(), err)
+		}
+		l.Printf("Error encountered: %v", errs)
+		return errs
+	}
+	last := samples[len(samples)-1]
+	l.Printf("%d samples within bounds; latest: RSS %d bytes, CPU %v, %d threads, %d open files",
+		len(samples), last.RSS, last.CPUTime, last.Threads, last.OpenFiles)
+	return nil
+}
+
+func (cmder *CommandExpectResources) String() string {
+	return fmt.Sprintf("ExpectResources:%v", cmder.source())
+}
+
+func (cmder *CommandExpectResources) Describe() string {
+	return fmt.Sprintf("Expect resource usage of %s within %+v", cmder.source(), cmder.bounds)
+}
@@ -0,0 +1,460 @@
+package harness
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"goshawkdb.io/client"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ClusterConfigReload. Sends SIGHUP to every RM of the config which
+// is running, so that they reread it.
+
+type ClusterConfigReload ClusterConfig
+
+func (cc *ClusterConfig) Reload() *ClusterConfigReload {
+	return (*ClusterConfigReload)(cc)
+}
+
+func (ccr *ClusterConfigReload) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ccr))
+
+	ccr.lock.Lock()
+	rms := append([]*RM{}, ccr.RMs...)
+	ccr.lock.Unlock()
+
+	for _, rm := range rms {
+		if eCmd, _ := rm.running(); eCmd == nil {
+			l.Printf("%s is not running; skipping", rm.name)
+			continue
+		}
+		if err := execInstruction(ctx, l, rm.Signal(syscall.SIGHUP)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ccr *ClusterConfigReload) String() string {
+	return fmt.Sprintf("ClusterConfigReload:%v", ccr.ClusterId)
+}
+
+func (ccr *ClusterConfigReload) Describe() string {
+	return fmt.Sprintf("Send SIGHUP to the running RMs of cluster %s", ccr.ClusterId)
+}
+
+// ClusterConfigAddClient. Grants a client certificate access to a
+// root in the live config: writes the next version and reloads it.
+
+type ClusterConfigAddClient struct {
+	*ClusterConfig
+	client      *ClientCertificate
+	root        string
+	read, write bool
+}
+
+func (cc *ClusterConfig) AddClient(client *ClientCertificate, root string, read, write bool) *ClusterConfigAddClient {
+	return &ClusterConfigAddClient{
+		ClusterConfig: cc,
+		client:        client,
+		root:          root,
+		read:          read,
+		write:         write,
+	}
+}
+
+func (ccac *ClusterConfigAddClient) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ccac))
+
+	return execInstruction(ctx, l, ccac.program())
+}
+
+func (ccac *ClusterConfigAddClient) program() Program {
+	return Program([]Instruction{
+		ccac.Update(func(cc *ClusterConfig) {
+			cc.GrantClient(ccac.client, ccac.root, ccac.read, ccac.write)
+		}),
+		ccac.Reload(),
+	})
+}
+
+func (ccac *ClusterConfigAddClient) String() string {
+	return fmt.Sprintf("ClusterConfigAddClient:%v", ccac.client.name)
+}
+
+func (ccac *ClusterConfigAddClient) Describe() string {
+	return fmt.Sprintf("Grant client %s access to root %s", ccac.client.name, ccac.root)
+}
+
+func (ccac *ClusterConfigAddClient) Walk(fun func(Instruction)) {
+	ccac.program().Walk(fun)
+}
+
+// ClusterConfigRevokeClient. Removes all access of a client
+// certificate from the live config: writes the next version and
+// reloads it.
+
+type ClusterConfigRevokeClient struct {
+	*ClusterConfig
+	client *ClientCertificate
+}
+
+func (cc *ClusterConfig) RevokeClient(client *ClientCertificate) *ClusterConfigRevokeClient {
+	return &ClusterConfigRevokeClient{
+		ClusterConfig: cc,
+		client:        client,
+	}
+}
+
+func (ccrc *ClusterConfigRevokeClient) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, ccrc))
+
+	return execInstruction(ctx, l, ccrc.program())
+}
+
+func (ccrc *ClusterConfigRevokeClient) program() Program {
+	return Program([]Instruction{
+		ccrc.Update(func(cc *ClusterConfig) {
+			delete(cc.ClientCertificates, ccrc.client)
+			if fingerprint := ccrc.client.Fingerprint(); len(fingerprint) > 0 {
+				delete(cc.ClientCertificateFingerprints, fingerprint)
+			}
+		}),
+		ccrc.Reload(),
+	})
+}
+
+func (ccrc *ClusterConfigRevokeClient) String() string {
+	return fmt.Sprintf("ClusterConfigRevokeClient:%v", ccrc.client.name)
+}
+
+func (ccrc *ClusterConfigRevokeClient) Describe() string {
+	return fmt.Sprintf("Revoke client %s", ccrc.client.name)
+}
+
+func (ccrc *ClusterConfigRevokeClient) Walk(fun func(Instruction)) {
+	ccrc.program().Walk(fun)
+}
+
+// ClientSession is a long-lived client connection to an RM, made with
+// a particular client certificate, for checking how the cluster
+// treats connected clients as certificates are added and revoked.
+type ClientSession struct {
+	setup  *Setup
+	client *ClientCertificate
+	rm     *RM
+	lock   sync.Mutex
+	conn   *client.Connection
+}
+
+func (s *Setup) NewClientSession(client *ClientCertificate, rm *RM) *ClientSession {
+	return &ClientSession{
+		setup:  s,
+		client: client,
+		rm:     rm,
+	}
+}
+
+func (cs *ClientSession) String() string {
+	return fmt.Sprintf("%v@%v", cs.client.name, cs.rm.name)
+}
+
+// rejection matches the errors with which a TLS handshake or the
+// server's check of the client certificate fails, either when
+// connecting or, once revoked, on an existing connection.
+var rejection = regexp.MustCompile(`(?i)tls:|x509:|certificate|unauthori[sz]ed|EOF|connection reset|broken pipe|connection.*closed`)
+
+// isRejection is true if err is the cluster refusing the client
+// certificate, rather than a timeout, cancellation or the RM being
+// unreachable.
+func isRejection(err error) bool {
+	if err == nil || errors.Is(err, errConnectTimeout) || errors.Is(err, errTransactTimeout) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return false
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var header tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &header) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	return rejection.MatchString(err.Error())
+}
+
+// connect makes a new connection, abandoning it if it does not
+// complete within timeout, in which case it's closed if and when it
+// does.
+func (cs *ClientSession) connect(ctx context.Context, timeout time.Duration) (*client.Connection, error) {
+	clusterCert := cs.setup.Certs.ClusterCert()
+	keyPair := cs.client.KeyPair()
+	if len(clusterCert) == 0 || len(keyPair) == 0 {
+		return nil, fmt.Errorf("Certificates for %v have not been generated", cs)
+	}
+	type result struct {
+		conn *client.Connection
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		conn, err := client.NewConnection(cs.rm.Host(), keyPair, clusterCert)
+		resultChan <- result{conn: conn, err: err}
+	}()
+	var err error
+	select {
+	case r := <-resultChan:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		err = errConnectTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	go func() {
+		if r := <-resultChan; r.err == nil {
+			r.conn.Shutdown()
+		}
+	}()
+	return nil, err
+}
+
+// transact runs a read of the roots over conn, abandoning it if it
+// does not complete within timeout.
+func (cs *ClientSession) transact(ctx context.Context, conn *client.Connection, timeout time.Duration) error {
+	resultChan := make(chan error, 1)
+	go func() {
+		_, _, err := conn.RunTransaction(func(txn *client.Txn) (interface{}, error) {
+			_, err := txn.GetRootObjects()
+			return nil, err
+		})
+		resultChan <- err
+	}()
+	select {
+	case err := <-resultChan:
+		return err
+	case <-time.After(timeout):
+		return errTransactTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cs *ClientSession) connection() *client.Connection {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.conn
+}
+
+// ClientSessionConnect. Opens the session's connection.
+
+type ClientSessionConnect ClientSession
+
+func (cs *ClientSession) Connect() *ClientSessionConnect {
+	return (*ClientSessionConnect)(cs)
+}
+
+func (csc *ClientSessionConnect) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, csc))
+
+	cs := (*ClientSession)(csc)
+	conn, err := cs.connect(ctx, cs.setup.ReadyTimeout)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	cs.lock.Lock()
+	if cs.conn != nil {
+		cs.conn.Shutdown()
+	}
+	cs.conn = conn
+	cs.lock.Unlock()
+	l.Printf("Connected to %s", cs.rm.Host())
+	return nil
+}
+
+func (csc *ClientSessionConnect) String() string {
+	return fmt.Sprintf("ClientSessionConnect:%v", (*ClientSession)(csc))
+}
+
+func (csc *ClientSessionConnect) Describe() string {
+	return fmt.Sprintf("Connect as client %s to RM %s", csc.client.name, csc.rm.name)
+}
+
+// ClientSessionClose. Closes the session's connection, if open.
+
+type ClientSessionClose ClientSession
+
+func (cs *ClientSession) Close() *ClientSessionClose {
+	return (*ClientSessionClose)(cs)
+}
+
+func (csc *ClientSessionClose) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, csc))
+
+	csc.lock.Lock()
+	defer csc.lock.Unlock()
+	if csc.conn != nil {
+		csc.conn.Shutdown()
+		csc.conn = nil
+	}
+	return nil
+}
+
+func (csc *ClientSessionClose) String() string {
+	return fmt.Sprintf("ClientSessionClose:%v", (*ClientSession)(csc))
+}
+
+func (csc *ClientSessionClose) Describe() string {
+	return fmt.Sprintf("Close the connection of %v", (*ClientSession)(csc))
+}
+
+// ClientSessionExpectWorking. Checks that the session's existing
+// connection can still run transactions, and that a new connection
+// with the same certificate can be made.
+
+type ClientSessionExpectWorking ClientSession
+
+func (cs *ClientSession) ExpectWorking() *ClientSessionExpectWorking {
+	return (*ClientSessionExpectWorking)(cs)
+}
+
+func (csew *ClientSessionExpectWorking) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, csew))
+
+	cs := (*ClientSession)(csew)
+	timeout := cs.setup.ReadyTimeout
+	conn := cs.connection()
+	if conn == nil {
+		err := fmt.Errorf("%v is not connected", cs)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	if err := cs.transact(ctx, conn, timeout); err != nil {
+		err = fmt.Errorf("%v: existing connection no longer works: %v", cs, err)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	fresh, err := cs.connect(ctx, timeout)
+	if err == nil {
+		err = cs.transact(ctx, fresh, timeout)
+		fresh.Shutdown()
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: new connection does not work: %v", cs, err)
+		l.Printf("Error encountered: %v", err)
+		return err
+	}
+	l.Print("Existing and new connections work")
+	return nil
+}
+
+func (csew *ClientSessionExpectWorking) String() string {
+	return fmt.Sprintf("ClientSessionExpectWorking:%v", (*ClientSession)(csew))
+}
+
+func (csew *ClientSessionExpectWorking) Describe() string {
+	return fmt.Sprintf("Expect connections of %v to work", (*ClientSession)(csew))
+}
+
+// ClientSessionExpectRejected. Checks that, within the timeout, the
+// session's existing connection (if any) is cut off, and new
+// connections with the same certificate are refused. Only a TLS or
+// certificate rejection counts: timeouts and refused connections
+// are retried until the timeout, and then fail.
+
+type ClientSessionExpectRejected struct {
+	*ClientSession
+	timeout time.Duration
+}
+
+func (cs *ClientSession) ExpectRejected(timeout time.Duration) *ClientSessionExpectRejected {
+	return &ClientSessionExpectRejected{
+		ClientSession: cs,
+		timeout:       timeout,
+	}
+}
+
+func (cser *ClientSessionExpectRejected) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, cser))
+
+	deadline := time.Now().Add(cser.timeout)
+	conn := cser.connection()
+	existingRejected := conn == nil
+	for {
+		newRejected := false
+		if remaining := deadline.Sub(time.Now()); remaining > 0 && !existingRejected {
+			if err := cser.transact(ctx, conn, remaining); isRejection(err) {
+				l.Printf("Existing connection rejected: %v", err)
+				existingRejected = true
+			} else if err != nil {
+				l.Printf("Existing connection failed, but not rejected: %v", err)
+			}
+		}
+		if remaining := deadline.Sub(time.Now()); remaining > 0 && existingRejected {
+			fresh, err := cser.connect(ctx, remaining)
+			if err == nil {
+				err = cser.transact(ctx, fresh, deadline.Sub(time.Now()))
+				fresh.Shutdown()
+			}
+			if isRejection(err) {
+				l.Printf("New connection rejected: %v", err)
+				newRejected = true
+			} else if err != nil {
+				l.Printf("New connection failed, but not rejected: %v", err)
+			}
+		}
+		if existingRejected && newRejected {
+			l.Print("Existing and new connections rejected")
+			return nil
+		}
+
+		var err error
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if !time.Now().Before(deadline) {
+			if existingRejected {
+				err = fmt.Errorf("%v: new connections not rejected within %v", cser.ClientSession, cser.timeout)
+			} else {
+				err = fmt.Errorf("%v: existing connection not rejected within %v", cser.ClientSession, cser.timeout)
+			}
+		}
+		if err != nil {
+			l.Printf("Error encountered: %v", err)
+			return err
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (cser *ClientSessionExpectRejected) String() string {
+	return fmt.Sprintf("ClientSessionExpectRejected:%v", cser.ClientSession)
+}
+
+func (cser *ClientSessionExpectRejected) Describe() string {
+	return fmt.Sprintf("Expect connections of %v to be rejected within %v", cser.ClientSession, cser.timeout)
+}
@@ -0,0 +1,41 @@
+package harness
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestIsRejection(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: err}
+	}
+	cases := []struct {
+		err      error
+		rejected bool
+	}{
+		{nil, false},
+		{errConnectTimeout, false},
+		{errTransactTimeout, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("Dial: %w", context.Canceled), false},
+		{opErr(syscall.ECONNREFUSED), false},
+		{errors.New("Retry needed"), false},
+
+		{io.EOF, true},
+		{opErr(syscall.ECONNRESET), true},
+		{x509.UnknownAuthorityError{}, true},
+		{errors.New("remote error: tls: bad certificate"), true},
+		{errors.New("Connection closed by server"), true},
+	}
+	for _, c := range cases {
+		if rejected := isRejection(c.err); rejected != c.rejected {
+			t.Errorf("%v: rejection %v; expected %v", c.err, rejected, c.rejected)
+		}
+	}
+}
@@ -0,0 +1,1040 @@
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Scenario is the declarative form of a harness Program. It is
+// normally loaded from a YAML or JSON file with LoadScenario.
+//
+//	configs:
+//	  v1: v1.json
+//	  v2: v2.json
+//	rms:
+//	  - name: one
+//	    port: 10001
+//	    config: v1
+//	steps:
+//	  - start: one
+//	  - awaitReady: one
+//	  - sleep: 5s
+//	  - parallel:
+//	      - terminate: one
+//	      - log: hello
+//
+// Relative paths are resolved against the directory containing the
+// scenario file. A config with an empty path is a placeholder that
+// can be filled in by a copy step. The name "dir" refers to
+// Setup.Dir.
+//
+// Instead of (or as well as) config files, a scenario can declare
+// clusters whose configs are generated from the RMs, and written out
+// by writeConfig steps. An RM may name a cluster as its config.
+//
+//	clusters:
+//	  c:
+//	    f: 0
+//	    maxRMCount: 5
+//	    rms: [one]
+//	steps:
+//	  - writeConfig: {cluster: c}
+//	  - start: one
+//	  - writeConfig: {cluster: c, rms: [one, two, three], f: 1}
+//
+// A scenario can also describe a topology migration, in which case
+// RMs without a config use the migration's generated config. If
+// there are no steps, the whole migration is run; otherwise its
+// stages (establish, migrate, awaitConvergence and teardown) can be
+// used as steps. If integrity is set, a graph of that many objects is
+// seeded before migrating and verified afterwards (or by the
+// seedIntegrity and verifyIntegrity stages). Added RMs start with
+// the end config; sighup lists the running RMs which are sent SIGHUP
+// to reread it (by default, all those in both topologies). The
+// migration has converged once clients see the added RMs serving, the
+// removed RMs not, and then the retained RMs serving, so the
+// topologies must differ in their RMs.
+//
+//	migration:
+//	  id: incr3
+//	  maxRMCount: 5
+//	  integrity: 32
+//	  from: {rms: [one], f: 0}
+//	  to: {rms: [one, two, three], f: 1}
+//	  sighup: []
+//
+// For mixed-version clusters and rolling upgrades, binaries can be
+// named: an RM may say which binary it starts with, and a swapBinary
+// step changes it while the RM is stopped.
+//
+//	binaries:
+//	  old: old/goshawkdb
+//	rms:
+//	  - {name: one, binary: old}
+//	steps:
+//	  - start: one
+//	  - terminate: one
+//	  - wait: one
+//	  - swapBinary: {rm: one, binary: default}
+//	  - start: one
+type Scenario struct {
+	Configs   map[string]string           `yaml:"configs" json:"configs"`
+	Clusters  map[string]*ScenarioCluster `yaml:"clusters" json:"clusters"`
+	Migration *ScenarioMigration          `yaml:"migration" json:"migration"`
+	RMs       []ScenarioRM                `yaml:"rms" json:"rms"`
+	Steps     []ScenarioStep              `yaml:"steps" json:"steps"`
+	// If set, the RMs' resource usage is sampled this often, for
+	// expectResources steps.
+	SampleInterval string `yaml:"sampleInterval" json:"sampleInterval"`
+	// Named goshawkdb binaries, for RMs' binary and swapBinary steps.
+	// The name "default" refers to Setup.GosBin.
+	Binaries map[string]string `yaml:"binaries" json:"binaries"`
+}
+
+// The cluster id defaults to the cluster's name.
+type ScenarioCluster struct {
+	Id         string   `yaml:"id" json:"id"`
+	F          uint8    `yaml:"f" json:"f"`
+	MaxRMCount uint16   `yaml:"maxRMCount" json:"maxRMCount"`
+	RMs        []string `yaml:"rms" json:"rms"`
+}
+
+type ScenarioMigration struct {
+	Id                 string           `yaml:"id" json:"id"`
+	MaxRMCount         uint16           `yaml:"maxRMCount" json:"maxRMCount"`
+	Integrity          int              `yaml:"integrity" json:"integrity"`
+	From               ScenarioTopology `yaml:"from" json:"from"`
+	To                 ScenarioTopology `yaml:"to" json:"to"`
+	ConvergenceTimeout string           `yaml:"convergenceTimeout" json:"convergenceTimeout"`
+	SIGHUP             []string         `yaml:"sighup" json:"sighup"`
+}
+
+type ScenarioTopology struct {
+	RMs []string `yaml:"rms" json:"rms"`
+	F   uint8    `yaml:"f" json:"f"`
+}
+
+// If the port is omitted, a free port is allocated.
+type ScenarioRM struct {
+	Name   string `yaml:"name" json:"name"`
+	Port   uint16 `yaml:"port" json:"port"`
+	Cert   string `yaml:"cert" json:"cert"`
+	Config string `yaml:"config" json:"config"`
+	Binary string `yaml:"binary" json:"binary"`
+}
+
+// Exactly one field of a ScenarioStep should be set.
+type ScenarioStep struct {
+	Start           string                   `yaml:"start" json:"start"`
+	Terminate       string                   `yaml:"terminate" json:"terminate"`
+	Kill            string                   `yaml:"kill" json:"kill"`
+	Wait            string                   `yaml:"wait" json:"wait"`
+	AwaitReady      string                   `yaml:"awaitReady" json:"awaitReady"`
+	Pause           string                   `yaml:"pause" json:"pause"`
+	Resume          string                   `yaml:"resume" json:"resume"`
+	PauseFor        *ScenarioPauseFor        `yaml:"pauseFor" json:"pauseFor"`
+	MarkLog         string                   `yaml:"markLog" json:"markLog"`
+	ExpectLog       *ScenarioExpectLog       `yaml:"expectLog" json:"expectLog"`
+	ExpectExit      *ScenarioExpectExit      `yaml:"expectExit" json:"expectExit"`
+	ExpectResources *ScenarioExpectResources `yaml:"expectResources" json:"expectResources"`
+	FillDisk        *ScenarioFillDisk        `yaml:"fillDisk" json:"fillDisk"`
+	FreeDisk        string                   `yaml:"freeDisk" json:"freeDisk"`
+	Corrupt         *ScenarioCorrupt         `yaml:"corrupt" json:"corrupt"`
+	ExpectRecovery  *ScenarioExpectRecovery  `yaml:"expectRecovery" json:"expectRecovery"`
+	Snapshot        *ScenarioSnapshot        `yaml:"snapshot" json:"snapshot"`
+	Restore         *ScenarioSnapshot        `yaml:"restore" json:"restore"`
+	SwapBinary      *ScenarioSwapBinary      `yaml:"swapBinary" json:"swapBinary"`
+	Signal          *ScenarioSignal          `yaml:"signal" json:"signal"`
+	Sleep           string                   `yaml:"sleep" json:"sleep"`
+	SleepRandom     *ScenarioSleepRandom     `yaml:"sleepRandom" json:"sleepRandom"`
+	Copy            *ScenarioCopy            `yaml:"copy" json:"copy"`
+	WriteConfig     *ScenarioWriteConfig     `yaml:"writeConfig" json:"writeConfig"`
+	Migration       string                   `yaml:"migration" json:"migration"`
+	Workload        *ScenarioWorkload        `yaml:"workload" json:"workload"`
+	Log             string                   `yaml:"log" json:"log"`
+	Program         []ScenarioStep           `yaml:"program" json:"program"`
+	Parallel        []ScenarioStep           `yaml:"parallel" json:"parallel"`
+	PickOne         []ScenarioStep           `yaml:"pickOne" json:"pickOne"`
+	PickWeighted    []ScenarioWeightedStep   `yaml:"pickWeighted" json:"pickWeighted"`
+	Repeat          *ScenarioRepeat          `yaml:"repeat" json:"repeat"`
+	Retry           *ScenarioRetry           `yaml:"retry" json:"retry"`
+	If              *ScenarioIf              `yaml:"if" json:"if"`
+	AbsorbError     *ScenarioStep            `yaml:"absorbError" json:"absorbError"`
+	Timeout         *ScenarioTimeout         `yaml:"timeout" json:"timeout"`
+	Loop            *ScenarioLoop            `yaml:"loop" json:"loop"`
+	Stop            string                   `yaml:"stop" json:"stop"`
+}
+
+type ScenarioSignal struct {
+	RM     string `yaml:"rm" json:"rm"`
+	Signal string `yaml:"signal" json:"signal"`
+}
+
+type ScenarioSleepRandom struct {
+	Min string `yaml:"min" json:"min"`
+	Max string `yaml:"max" json:"max"`
+}
+
+type ScenarioPauseFor struct {
+	RM  string `yaml:"rm" json:"rm"`
+	Min string `yaml:"min" json:"min"`
+	Max string `yaml:"max" json:"max"`
+}
+
+type ScenarioExpectLog struct {
+	RM      string `yaml:"rm" json:"rm"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Timeout string `yaml:"timeout" json:"timeout"`
+}
+
+// Waits for an RM to end. If clean is set, it must exit with status 0;
+// otherwise only a panic is an error.
+type ScenarioExpectExit struct {
+	RM    string `yaml:"rm" json:"rm"`
+	Clean bool   `yaml:"clean" json:"clean"`
+}
+
+// Checks an RM's resource usage so far. Bounds which are not given
+// are not checked. maxRSSGrowth is a percentage, measured from the
+// first sample after warmup.
+type ScenarioExpectResources struct {
+	RM           string  `yaml:"rm" json:"rm"`
+	MaxRSSMiB    uint64  `yaml:"maxRSSMiB" json:"maxRSSMiB"`
+	MaxThreads   int     `yaml:"maxThreads" json:"maxThreads"`
+	MaxOpenFiles int     `yaml:"maxOpenFiles" json:"maxOpenFiles"`
+	MaxRSSGrowth float64 `yaml:"maxRSSGrowth" json:"maxRSSGrowth"`
+	Warmup       string  `yaml:"warmup" json:"warmup"`
+}
+
+// Fills the filesystem holding an RM's dir, leaving leaveMiB free.
+// freeDisk undoes it.
+type ScenarioFillDisk struct {
+	RM       string `yaml:"rm" json:"rm"`
+	LeaveMiB uint64 `yaml:"leaveMiB" json:"leaveMiB"`
+}
+
+// Damages up to files files (default 1) of a stopped RM. The mode is
+// truncate or bitflip.
+type ScenarioCorrupt struct {
+	RM    string `yaml:"rm" json:"rm"`
+	Mode  string `yaml:"mode" json:"mode"`
+	Files int    `yaml:"files" json:"files"`
+}
+
+// Starts an RM and expects it either to become ready or to exit
+// non-zero, without panicking, having logged a line matching refusal,
+// which is required.
+type ScenarioExpectRecovery struct {
+	RM      string `yaml:"rm" json:"rm"`
+	Timeout string `yaml:"timeout" json:"timeout"`
+	Refusal string `yaml:"refusal" json:"refusal"`
+}
+
+// Names a snapshot of a stopped RM's data, for the snapshot and
+// restore steps.
+type ScenarioSnapshot struct {
+	RM    string `yaml:"rm" json:"rm"`
+	Label string `yaml:"label" json:"label"`
+}
+
+// Makes a stopped RM run the named binary when next started.
+type ScenarioSwapBinary struct {
+	RM     string `yaml:"rm" json:"rm"`
+	Binary string `yaml:"binary" json:"binary"`
+}
+
+type ScenarioCopy struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+	As   string `yaml:"as" json:"as"`
+}
+
+// Writes the next version of a cluster's config. Fields which are
+// not given are left as they were.
+type ScenarioWriteConfig struct {
+	Cluster    string   `yaml:"cluster" json:"cluster"`
+	RMs        []string `yaml:"rms" json:"rms"`
+	F          *uint8   `yaml:"f" json:"f"`
+	MaxRMCount *uint16  `yaml:"maxRMCount" json:"maxRMCount"`
+}
+
+type ScenarioTimeout struct {
+	Duration string       `yaml:"duration" json:"duration"`
+	Step     ScenarioStep `yaml:"step" json:"step"`
+}
+
+// Workloads are looked up by the name given to RegisterWorkload. If
+// no RMs are listed, the workload runs against all those running.
+type ScenarioWorkload struct {
+	Name string   `yaml:"name" json:"name"`
+	RMs  []string `yaml:"rms" json:"rms"`
+}
+
+// A loop with an Id runs until stopped by a stop step naming that
+// Id (or until error). A loop without an Id runs until error.
+type ScenarioLoop struct {
+	Id    string         `yaml:"id" json:"id"`
+	Steps []ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+// Exactly one of times and for should be set.
+type ScenarioRepeat struct {
+	Times int            `yaml:"times" json:"times"`
+	For   string         `yaml:"for" json:"for"`
+	Steps []ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+type ScenarioWeightedStep struct {
+	Weight uint         `yaml:"weight" json:"weight"`
+	Step   ScenarioStep `yaml:"step" json:"step"`
+}
+
+// Backoff is the wait before the first retry; it doubles for each
+// further retry.
+type ScenarioRetry struct {
+	Attempts int          `yaml:"attempts" json:"attempts"`
+	Backoff  string       `yaml:"backoff" json:"backoff"`
+	Step     ScenarioStep `yaml:"step" json:"step"`
+}
+
+// Runs the attempt step, and then the then steps if it succeeded, or
+// the else steps if it failed. The attempt's error is not passed on.
+type ScenarioIf struct {
+	Attempt ScenarioStep   `yaml:"attempt" json:"attempt"`
+	Then    []ScenarioStep `yaml:"then" json:"then"`
+	Else    []ScenarioStep `yaml:"else" json:"else"`
+}
+
+// LoadScenario reads the scenario file at path and builds the
+// Program it describes against setup. The returned Program starts
+// with setup itself, so it can be passed straight to Run.
+func LoadScenario(setup *Setup, path string) (Program, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scenario := &Scenario{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// As strict as UnmarshalStrict: unknown fields and trailing
+		// data are errors.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(scenario); err == nil && dec.More() {
+			err = errors.New("Unexpected data after the scenario")
+		}
+	default:
+		err = yaml.UnmarshalStrict(data, scenario)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse scenario %s: %v", path, err)
+	}
+	return scenario.Program(setup, filepath.Dir(path))
+}
+
+// Program builds the Instruction tree for the scenario. Relative
+// paths are resolved against baseDir.
+func (sc *Scenario) Program(setup *Setup, baseDir string) (Program, error) {
+	b := &scenarioBuilder{
+		setup:    setup,
+		baseDir:  baseDir,
+		configs:  map[string]*PathProvider{"dir": setup.Dir},
+		binaries: map[string]*PathProvider{"default": setup.GosBin},
+		clusters: make(map[string]*ClusterConfig, len(sc.Clusters)),
+		rms:      make(map[string]*RM, len(sc.RMs)),
+		loops:    make(map[string]*UntilStopped),
+	}
+
+	if len(sc.SampleInterval) > 0 {
+		d, err := time.ParseDuration(sc.SampleInterval)
+		if err != nil {
+			return nil, err
+		}
+		setup.SampleInterval = d
+	}
+
+	for name, p := range sc.Configs {
+		if name == "dir" {
+			return nil, errors.New(`Config name "dir" is reserved`)
+		}
+		pp, err := b.path(p)
+		if err != nil {
+			return nil, err
+		}
+		b.configs[name] = pp
+	}
+
+	for name, p := range sc.Binaries {
+		if name == "default" {
+			return nil, errors.New(`Binary name "default" is reserved`)
+		}
+		pp, err := b.path(p)
+		if err != nil {
+			return nil, err
+		}
+		b.binaries[name] = pp
+	}
+
+	for name, scCluster := range sc.Clusters {
+		if _, found := b.configs[name]; found {
+			return nil, fmt.Errorf("Cluster name %s is already used by a config", name)
+		}
+		id := scCluster.Id
+		if len(id) == 0 {
+			id = name
+		}
+		cc := setup.NewClusterConfig(id, scCluster.F, scCluster.MaxRMCount)
+		b.clusters[name] = cc
+		b.configs[name] = cc.Path()
+	}
+
+	var migrationConfig *ClusterConfig
+	if sc.Migration != nil {
+		if len(sc.Migration.Id) == 0 {
+			return nil, errors.New("Migration without id")
+		}
+		migrationConfig = setup.NewClusterConfig(sc.Migration.Id, sc.Migration.From.F, sc.Migration.MaxRMCount)
+	}
+
+	for _, scRM := range sc.RMs {
+		if len(scRM.Name) == 0 {
+			return nil, errors.New("RM without name")
+		}
+		if _, found := b.rms[scRM.Name]; found {
+			return nil, fmt.Errorf("Duplicate RM name: %s", scRM.Name)
+		}
+		var certPath, configPath *PathProvider
+		if len(scRM.Cert) > 0 {
+			pp, err := b.path(scRM.Cert)
+			if err != nil {
+				return nil, err
+			}
+			certPath = pp
+		}
+		if len(scRM.Config) > 0 {
+			pp, found := b.configs[scRM.Config]
+			if !found {
+				return nil, fmt.Errorf("RM %s: unknown config %s", scRM.Name, scRM.Config)
+			}
+			configPath = pp
+		} else if migrationConfig != nil {
+			configPath = migrationConfig.Path()
+		}
+		rm := setup.NewRM(scRM.Name, scRM.Port, certPath, configPath)
+		if len(scRM.Binary) > 0 {
+			binPath, err := b.binary(scRM.Binary)
+			if err != nil {
+				return nil, fmt.Errorf("RM %s: %v", scRM.Name, err)
+			}
+			rm.SetBinary(binPath)
+		}
+		b.rms[scRM.Name] = rm
+	}
+
+	for name, scCluster := range sc.Clusters {
+		rms, err := b.rmList(scCluster.RMs)
+		if err != nil {
+			return nil, fmt.Errorf("Cluster %s: %v", name, err)
+		}
+		b.clusters[name].RMs = rms
+	}
+
+	if sc.Migration != nil {
+		migration, err := b.migration(sc.Migration, migrationConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Migration: %v", err)
+		}
+		b.migrationInstr = migration
+		if len(sc.Steps) == 0 {
+			return Program{setup, migration}, nil
+		}
+	}
+
+	steps, err := b.steps(sc.Steps)
+	if err != nil {
+		return nil, err
+	}
+	return append(Program{setup}, steps...), nil
+}
+
+type scenarioBuilder struct {
+	setup    *Setup
+	baseDir  string
+	configs  map[string]*PathProvider
+	binaries map[string]*PathProvider
+	clusters map[string]*ClusterConfig
+	rms      map[string]*RM
+	loops    map[string]*UntilStopped
+	// The scenario's migration, if any.
+	migrationInstr *Migration
+}
+
+func (b *scenarioBuilder) path(p string) (*PathProvider, error) {
+	if len(p) > 0 && !filepath.IsAbs(p) {
+		p = filepath.Join(b.baseDir, p)
+	}
+	return NewPathProvider(p, false)
+}
+
+func (b *scenarioBuilder) binary(name string) (*PathProvider, error) {
+	if pp, found := b.binaries[name]; found {
+		return pp, nil
+	}
+	return nil, fmt.Errorf("Unknown binary: %s", name)
+}
+
+func (b *scenarioBuilder) rm(name string) (*RM, error) {
+	if rm, found := b.rms[name]; found {
+		return rm, nil
+	}
+	return nil, fmt.Errorf("Unknown RM: %s", name)
+}
+
+func (b *scenarioBuilder) rmList(names []string) ([]*RM, error) {
+	rms := make([]*RM, len(names))
+	for idx, name := range names {
+		rm, err := b.rm(name)
+		if err != nil {
+			return nil, err
+		}
+		rms[idx] = rm
+	}
+	return rms, nil
+}
+
+func (b *scenarioBuilder) config(name string) (*PathProvider, error) {
+	if pp, found := b.configs[name]; found {
+		return pp, nil
+	}
+	return nil, fmt.Errorf("Unknown config: %s", name)
+}
+
+func (b *scenarioBuilder) steps(steps []ScenarioStep) ([]Instruction, error) {
+	instrs := make([]Instruction, len(steps))
+	for idx := range steps {
+		instr, err := b.step(&steps[idx])
+		if err != nil {
+			return nil, fmt.Errorf("Step %d: %v", idx, err)
+		}
+		instrs[idx] = instr
+	}
+	return instrs, nil
+}
+
+func (b *scenarioBuilder) step(step *ScenarioStep) (Instruction, error) {
+	var instr Instruction
+	count := 0
+	set := func(i Instruction, err error) error {
+		count++
+		instr = i
+		return err
+	}
+	var err error
+	if len(step.Start) > 0 {
+		err = set(b.rmInstr(step.Start, func(rm *RM) Instruction { return rm.Start() }))
+	}
+	if err == nil && len(step.Terminate) > 0 {
+		err = set(b.rmInstr(step.Terminate, func(rm *RM) Instruction { return rm.Terminate() }))
+	}
+	if err == nil && len(step.Kill) > 0 {
+		err = set(b.rmInstr(step.Kill, func(rm *RM) Instruction { return rm.Kill() }))
+	}
+	if err == nil && len(step.Wait) > 0 {
+		err = set(b.rmInstr(step.Wait, func(rm *RM) Instruction { return rm.Wait() }))
+	}
+	if err == nil && len(step.AwaitReady) > 0 {
+		err = set(b.rmInstr(step.AwaitReady, func(rm *RM) Instruction { return rm.AwaitReady() }))
+	}
+	if err == nil && len(step.Pause) > 0 {
+		err = set(b.rmInstr(step.Pause, func(rm *RM) Instruction { return rm.Pause() }))
+	}
+	if err == nil && len(step.Resume) > 0 {
+		err = set(b.rmInstr(step.Resume, func(rm *RM) Instruction { return rm.Resume() }))
+	}
+	if err == nil && step.PauseFor != nil {
+		err = set(b.pauseFor(step.PauseFor))
+	}
+	if err == nil && len(step.MarkLog) > 0 {
+		err = set(b.rmInstr(step.MarkLog, func(rm *RM) Instruction { return rm.MarkLog() }))
+	}
+	if err == nil && step.ExpectLog != nil {
+		err = set(b.expectLog(step.ExpectLog))
+	}
+	if err == nil && step.ExpectExit != nil {
+		err = set(b.rmInstr(step.ExpectExit.RM, func(rm *RM) Instruction { return rm.ExpectExit(step.ExpectExit.Clean) }))
+	}
+	if err == nil && step.ExpectResources != nil {
+		err = set(b.expectResources(step.ExpectResources))
+	}
+	if err == nil && step.FillDisk != nil {
+		err = set(b.rmInstr(step.FillDisk.RM, func(rm *RM) Instruction { return rm.FillDisk(step.FillDisk.LeaveMiB * 1024 * 1024) }))
+	}
+	if err == nil && len(step.FreeDisk) > 0 {
+		err = set(b.rmInstr(step.FreeDisk, func(rm *RM) Instruction { return rm.FreeDisk() }))
+	}
+	if err == nil && step.Corrupt != nil {
+		err = set(b.corrupt(step.Corrupt))
+	}
+	if err == nil && step.ExpectRecovery != nil {
+		err = set(b.expectRecovery(step.ExpectRecovery))
+	}
+	if err == nil && step.Snapshot != nil {
+		err = set(b.rmInstr(step.Snapshot.RM, func(rm *RM) Instruction { return rm.Snapshot(step.Snapshot.Label) }))
+	}
+	if err == nil && step.Restore != nil {
+		err = set(b.rmInstr(step.Restore.RM, func(rm *RM) Instruction { return rm.Restore(step.Restore.Label) }))
+	}
+	if err == nil && step.SwapBinary != nil {
+		err = set(b.swapBinary(step.SwapBinary))
+	}
+	if err == nil && step.Signal != nil {
+		err = set(b.signal(step.Signal))
+	}
+	if err == nil && len(step.Sleep) > 0 {
+		d, errParse := time.ParseDuration(step.Sleep)
+		err = set(b.setup.Sleep(d), errParse)
+	}
+	if err == nil && step.SleepRandom != nil {
+		err = set(b.sleepRandom(step.SleepRandom))
+	}
+	if err == nil && step.Copy != nil {
+		err = set(b.copy(step.Copy))
+	}
+	if err == nil && step.WriteConfig != nil {
+		err = set(b.writeConfig(step.WriteConfig))
+	}
+	if err == nil && len(step.Migration) > 0 {
+		err = set(b.migrationStage(step.Migration))
+	}
+	if err == nil && step.Workload != nil {
+		err = set(b.workload(step.Workload))
+	}
+	if err == nil && len(step.Log) > 0 {
+		err = set(b.setup.Log(step.Log), nil)
+	}
+	if err == nil && step.Program != nil {
+		instrs, errSteps := b.steps(step.Program)
+		err = set(Program(instrs), errSteps)
+	}
+	if err == nil && step.Parallel != nil {
+		instrs, errSteps := b.steps(step.Parallel)
+		err = set(b.setup.InParallel(instrs...), errSteps)
+	}
+	if err == nil && step.PickOne != nil {
+		if len(step.PickOne) == 0 {
+			err = set(nil, errors.New("pickOne requires at least one step"))
+		} else {
+			instrs, errSteps := b.steps(step.PickOne)
+			err = set(b.setup.PickOne(instrs...), errSteps)
+		}
+	}
+	if err == nil && step.PickWeighted != nil {
+		err = set(b.pickWeighted(step.PickWeighted))
+	}
+	if err == nil && step.Repeat != nil {
+		err = set(b.repeat(step.Repeat))
+	}
+	if err == nil && step.Retry != nil {
+		err = set(b.retry(step.Retry))
+	}
+	if err == nil && step.If != nil {
+		err = set(b.ifStep(step.If))
+	}
+	if err == nil && step.AbsorbError != nil {
+		wrapped, errStep := b.step(step.AbsorbError)
+		err = set(b.setup.AbsorbError(wrapped), errStep)
+	}
+	if err == nil && step.Timeout != nil {
+		err = set(b.timeout(step.Timeout))
+	}
+	if err == nil && step.Loop != nil {
+		err = set(b.loop(step.Loop))
+	}
+	if err == nil && len(step.Stop) > 0 {
+		if us, found := b.loops[step.Stop]; found {
+			err = set(us.Stop(), nil)
+		} else {
+			err = set(nil, fmt.Errorf("Unknown loop: %s", step.Stop))
+		}
+	}
+
+	switch {
+	case err != nil:
+		return nil, err
+	case count == 0:
+		return nil, errors.New("Empty step")
+	case count > 1:
+		return nil, errors.New("Step has more than one instruction")
+	default:
+		return instr, nil
+	}
+}
+
+func (b *scenarioBuilder) rmInstr(name string, fun func(*RM) Instruction) (Instruction, error) {
+	rm, err := b.rm(name)
+	if err != nil {
+		return nil, err
+	}
+	return fun(rm), nil
+}
+
+func (b *scenarioBuilder) signal(sig *ScenarioSignal) (Instruction, error) {
+	rm, err := b.rm(sig.RM)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseSignal(sig.Signal)
+	if err != nil {
+		return nil, err
+	}
+	return rm.Signal(s), nil
+}
+
+func (b *scenarioBuilder) sleepRandom(sr *ScenarioSleepRandom) (Instruction, error) {
+	min, max, err := parseDurations(sr.Min, sr.Max)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.SleepRandom(min, max), nil
+}
+
+func (b *scenarioBuilder) pauseFor(pf *ScenarioPauseFor) (Instruction, error) {
+	rm, err := b.rm(pf.RM)
+	if err != nil {
+		return nil, err
+	}
+	min, max, err := parseDurations(pf.Min, pf.Max)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.PauseFor(rm, min, max), nil
+}
+
+func (b *scenarioBuilder) expectResources(er *ScenarioExpectResources) (Instruction, error) {
+	rm, err := b.rm(er.RM)
+	if err != nil {
+		return nil, err
+	}
+	bounds := ResourceBounds{
+		MaxRSS:       er.MaxRSSMiB * 1024 * 1024,
+		MaxThreads:   er.MaxThreads,
+		MaxOpenFiles: er.MaxOpenFiles,
+		MaxRSSGrowth: er.MaxRSSGrowth,
+	}
+	if len(er.Warmup) > 0 {
+		if bounds.Warmup, err = time.ParseDuration(er.Warmup); err != nil {
+			return nil, err
+		}
+	}
+	return rm.ExpectResources(bounds), nil
+}
+
+func (b *scenarioBuilder) swapBinary(sb *ScenarioSwapBinary) (Instruction, error) {
+	rm, err := b.rm(sb.RM)
+	if err != nil {
+		return nil, err
+	}
+	binPath, err := b.binary(sb.Binary)
+	if err != nil {
+		return nil, err
+	}
+	return rm.SwapBinary(binPath), nil
+}
+
+func (b *scenarioBuilder) corrupt(c *ScenarioCorrupt) (Instruction, error) {
+	rm, err := b.rm(c.RM)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := ParseCorruptMode(c.Mode)
+	if err != nil {
+		return nil, err
+	}
+	files := c.Files
+	if files == 0 {
+		files = 1
+	}
+	return rm.Corrupt(mode, files), nil
+}
+
+func (b *scenarioBuilder) expectRecovery(er *ScenarioExpectRecovery) (Instruction, error) {
+	rm, err := b.rm(er.RM)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := time.ParseDuration(er.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(er.Refusal) == 0 {
+		return nil, errors.New("expectRecovery without refusal")
+	}
+	refusal, err := regexp.Compile(er.Refusal)
+	if err != nil {
+		return nil, err
+	}
+	return rm.ExpectRecovery(timeout, refusal), nil
+}
+
+func (b *scenarioBuilder) expectLog(el *ScenarioExpectLog) (Instruction, error) {
+	rm, err := b.rm(el.RM)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(el.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := time.ParseDuration(el.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return rm.ExpectLog(re, timeout), nil
+}
+
+func parseDurations(minStr, maxStr string) (min, max time.Duration, err error) {
+	if min, err = time.ParseDuration(minStr); err != nil {
+		return
+	}
+	max, err = time.ParseDuration(maxStr)
+	return
+}
+
+func (b *scenarioBuilder) copy(c *ScenarioCopy) (Instruction, error) {
+	from, err := b.config(c.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := b.config(c.To)
+	if err != nil {
+		return nil, err
+	}
+	receiver := to
+	if len(c.As) > 0 {
+		if receiver, err = b.config(c.As); err != nil {
+			return nil, err
+		}
+	}
+	return from.CopyTo(to, receiver), nil
+}
+
+func (b *scenarioBuilder) writeConfig(wc *ScenarioWriteConfig) (Instruction, error) {
+	cc, found := b.clusters[wc.Cluster]
+	if !found {
+		return nil, fmt.Errorf("Unknown cluster: %s", wc.Cluster)
+	}
+	if wc.RMs == nil && wc.F == nil && wc.MaxRMCount == nil {
+		return cc.Write(), nil
+	}
+	rms, err := b.rmList(wc.RMs)
+	if err != nil {
+		return nil, err
+	}
+	return cc.Update(func(cc *ClusterConfig) {
+		if wc.RMs != nil {
+			cc.RMs = rms
+		}
+		if wc.F != nil {
+			cc.F = *wc.F
+		}
+		if wc.MaxRMCount != nil {
+			cc.MaxRMCount = *wc.MaxRMCount
+		}
+	}), nil
+}
+
+func (b *scenarioBuilder) migration(sm *ScenarioMigration, config *ClusterConfig) (*Migration, error) {
+	from, err := b.rmList(sm.From.RMs)
+	if err != nil {
+		return nil, err
+	}
+	to, err := b.rmList(sm.To.RMs)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 || len(to) == 0 {
+		return nil, errors.New("Migration: both topologies must contain at least one RM")
+	}
+	m := b.setup.NewMigration(config, Topology{RMs: from, F: sm.From.F}, Topology{RMs: to, F: sm.To.F})
+	if len(sm.ConvergenceTimeout) > 0 {
+		if m.ConvergenceTimeout, err = time.ParseDuration(sm.ConvergenceTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if sm.Integrity > 0 {
+		m.Integrity = b.setup.NewIntegrity(sm.Integrity)
+	}
+	if sm.SIGHUP != nil {
+		if m.SIGHUP, err = b.rmList(sm.SIGHUP); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (b *scenarioBuilder) migrationStage(stage string) (Instruction, error) {
+	m := b.migrationInstr
+	if m == nil {
+		return nil, errors.New("Scenario has no migration")
+	}
+	switch stage {
+	case "establish":
+		return m.Establish(), nil
+	case "migrate":
+		return m.Migrate(), nil
+	case "awaitConvergence":
+		return m.AwaitConvergence(), nil
+	case "teardown":
+		return m.Teardown(), nil
+	case "seedIntegrity", "verifyIntegrity":
+		if m.Integrity == nil {
+			return nil, errors.New("Migration has no integrity")
+		}
+		if stage == "seedIntegrity" {
+			return m.Integrity.Seed(m.from.RMs[0]), nil
+		}
+		return m.Integrity.Verify(m.to.RMs...), nil
+	default:
+		return nil, fmt.Errorf("Unknown migration stage: %s", stage)
+	}
+}
+
+func (b *scenarioBuilder) timeout(t *ScenarioTimeout) (Instruction, error) {
+	d, err := time.ParseDuration(t.Duration)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := b.step(&t.Step)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.WithTimeout(d, wrapped), nil
+}
+
+func (b *scenarioBuilder) pickWeighted(steps []ScenarioWeightedStep) (Instruction, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("pickWeighted requires at least one step")
+	}
+	choices := make([]WeightedChoice, len(steps))
+	for idx := range steps {
+		instr, err := b.step(&steps[idx].Step)
+		if err != nil {
+			return nil, fmt.Errorf("Choice %d: %v", idx, err)
+		}
+		choices[idx] = WeightedChoice{Weight: steps[idx].Weight, Instruction: instr}
+	}
+	return b.setup.PickWeighted(choices...), nil
+}
+
+func (b *scenarioBuilder) repeat(r *ScenarioRepeat) (Instruction, error) {
+	if (r.Times > 0) == (len(r.For) > 0) {
+		return nil, errors.New("repeat requires exactly one of times and for")
+	}
+	instrs, err := b.steps(r.Steps)
+	if err != nil {
+		return nil, err
+	}
+	if r.Times > 0 {
+		return b.setup.Repeat(r.Times, Program(instrs)), nil
+	}
+	d, err := time.ParseDuration(r.For)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.RepeatFor(d, Program(instrs)), nil
+}
+
+func (b *scenarioBuilder) retry(r *ScenarioRetry) (Instruction, error) {
+	var backoff time.Duration
+	if len(r.Backoff) > 0 {
+		var err error
+		if backoff, err = time.ParseDuration(r.Backoff); err != nil {
+			return nil, err
+		}
+	}
+	wrapped, err := b.step(&r.Step)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.Retry(r.Attempts, backoff, wrapped), nil
+}
+
+func (b *scenarioBuilder) ifStep(i *ScenarioIf) (Instruction, error) {
+	wrapped, err := b.step(&i.Attempt)
+	if err != nil {
+		return nil, err
+	}
+	then, err := b.steps(i.Then)
+	if err != nil {
+		return nil, err
+	}
+	var els Instruction
+	if len(i.Else) > 0 {
+		instrs, err := b.steps(i.Else)
+		if err != nil {
+			return nil, err
+		}
+		els = Program(instrs)
+	}
+	attempt := b.setup.Attempt(wrapped)
+	return Program([]Instruction{attempt, b.setup.If(attempt.Succeeded(), Program(then), els)}), nil
+}
+
+func (b *scenarioBuilder) workload(w *ScenarioWorkload) (Instruction, error) {
+	fun, found := workloads[w.Name]
+	if !found {
+		return nil, fmt.Errorf("Unknown workload: %s", w.Name)
+	}
+	rms, err := b.rmList(w.RMs)
+	if err != nil {
+		return nil, err
+	}
+	return b.setup.Workload(w.Name, fun, rms...), nil
+}
+
+func (b *scenarioBuilder) loop(loop *ScenarioLoop) (Instruction, error) {
+	instrs, err := b.steps(loop.Steps)
+	if err != nil {
+		return nil, err
+	}
+	if len(loop.Id) == 0 {
+		return b.setup.UntilError(Program(instrs)), nil
+	}
+	if _, found := b.loops[loop.Id]; found {
+		return nil, fmt.Errorf("Duplicate loop id: %s", loop.Id)
+	}
+	us := b.setup.UntilStopped(Program(instrs))
+	b.loops[loop.Id] = us
+	return us, nil
+}
+
+var signalNames = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+}
+
+// ParseSignal accepts signal names with or without the SIG prefix,
+// e.g. "HUP" or "SIGHUP".
+func ParseSignal(name string) (os.Signal, error) {
+	if sig, found := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; found {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("Unknown signal: %s", name)
+}
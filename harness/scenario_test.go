@@ -0,0 +1,175 @@
+package harness
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadScenarioString(t *testing.T, name, content string) (Program, error) {
+	dir, err := ioutil.TempDir("", "scenario_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadScenario(NewSetup(), path)
+}
+
+func TestLoadScenario(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		content string
+		// The number of instructions after setup, or the error
+		// expected.
+		steps int
+		err   string
+	}{
+		{name: "yaml", file: "s.yaml", steps: 3, content: `
+rms:
+  - {name: one, port: 10001}
+steps:
+  - start: one
+  - terminate: one
+  - wait: one
+`},
+		{name: "json", file: "s.json", steps: 2, content: `
+{"rms": [{"name": "one", "port": 10001}],
+ "steps": [{"start": "one"}, {"sleep": "1s"}]}
+`},
+		{name: "nested", file: "s.yaml", steps: 1, content: `
+rms:
+  - {name: one, port: 10001}
+steps:
+  - parallel:
+      - start: one
+      - sleepRandom: {min: 1s, max: 2s}
+`},
+		{name: "migration without steps", file: "s.yaml", steps: 1, content: `
+rms:
+  - {name: one, port: 10001}
+  - {name: two, port: 10002}
+migration:
+  id: m
+  from: {rms: [one], f: 0}
+  to: {rms: [one, two], f: 0}
+`},
+		{name: "unknown field", file: "s.yaml", err: "Unable to parse scenario", content: `
+rms:
+  - {name: one, prot: 10001}
+`},
+		{name: "unknown JSON field", file: "s.json", err: `unknown field "prot"`, content: `
+{"rms": [{"name": "one", "prot": 10001}]}
+`},
+		{name: "trailing JSON", file: "s.json", err: "Unexpected data after the scenario", content: `
+{"rms": [{"name": "one", "port": 10001}]}
+{"steps": []}
+`},
+		{name: "RM without name", file: "s.yaml", err: "RM without name", content: `
+rms:
+  - {port: 10001}
+`},
+		{name: "duplicate RM", file: "s.yaml", err: "Duplicate RM name: one", content: `
+rms:
+  - {name: one, port: 10001}
+  - {name: one, port: 10002}
+`},
+		{name: "unknown RM", file: "s.yaml", err: "Step 0: Unknown RM: two", content: `
+rms:
+  - {name: one, port: 10001}
+steps:
+  - start: two
+`},
+		{name: "empty step", file: "s.yaml", err: "Step 1: Empty step", content: `
+rms:
+  - {name: one, port: 10001}
+steps:
+  - start: one
+  - {}
+`},
+		{name: "two instructions", file: "s.yaml", err: "Step 0: Step has more than one instruction", content: `
+rms:
+  - {name: one, port: 10001}
+steps:
+  - {start: one, terminate: one}
+`},
+		{name: "bad duration", file: "s.yaml", err: "Step 0:", content: `
+steps:
+  - sleep: soon
+`},
+		{name: "migration without id", file: "s.yaml", err: "Migration without id", content: `
+rms:
+  - {name: one, port: 10001}
+migration:
+  from: {rms: [one], f: 0}
+  to: {rms: [one], f: 0}
+`},
+		{name: "migration from nothing", file: "s.yaml", err: "both topologies must contain at least one RM", content: `
+rms:
+  - {name: one, port: 10001}
+migration:
+  id: m
+  integrity: 8
+  from: {rms: [], f: 0}
+  to: {rms: [one], f: 0}
+steps:
+  - migration: seedIntegrity
+`},
+	}
+	for _, c := range cases {
+		prog, err := loadScenarioString(t, c.file, c.content)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v; expected %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if _, ok := prog[0].(*Setup); !ok || len(prog) != c.steps+1 {
+			t.Errorf("%s: got %d instructions, starting with %v; expected setup then %d", c.name, len(prog), prog[0], c.steps)
+		}
+	}
+}
+
+func TestLoadScenarioMigrationSIGHUP(t *testing.T) {
+	cases := []struct {
+		sighup string
+		rms    string
+	}{
+		// By default, the RMs in both topologies.
+		{"", "[one two]"},
+		{"  sighup: []\n", "[]"},
+		{"  sighup: [three]\n", "[three]"},
+	}
+	for _, c := range cases {
+		prog, err := loadScenarioString(t, "s.yaml", `
+rms:
+  - {name: one, port: 10001}
+  - {name: two, port: 10002}
+  - {name: three, port: 10003}
+migration:
+  id: m
+  from: {rms: [one, two, three], f: 0}
+  to: {rms: [one, two], f: 0}
+`+c.sighup)
+		if err != nil {
+			t.Fatalf("%q: %v", c.sighup, err)
+		}
+		m, ok := prog[1].(*Migration)
+		if !ok {
+			t.Fatalf("%q: got %v; expected a migration", c.sighup, prog[1])
+		}
+		if rms := rmNames(m.sighup()); strings.Join(rms, " ") != strings.Trim(c.rms, "[]") {
+			t.Errorf("%q: SIGHUP %v; expected %s", c.sighup, rms, c.rms)
+		}
+	}
+}
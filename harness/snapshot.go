@@ -0,0 +1,207 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dataDir is the RM's own dir under Setup.Dir, which it is given as
+// its -dir.
+func (rm *RM) dataDir() string {
+	return filepath.Join(rm.setup.Dir.Path(), rm.name)
+}
+
+func (rm *RM) snapshotDir(label string) string {
+	return filepath.Join(rm.setup.Dir.Path(), rm.name+".snapshots", label)
+}
+
+// stopped errors unless the RM's process has ended and been waited
+// for, so that its files can be safely changed.
+func (rm *RM) stopped() error {
+	if eCmd, _ := rm.running(); eCmd != nil {
+		return fmt.Errorf("RM %s is running (or has not been waited for)", rm.name)
+	}
+	return nil
+}
+
+// RMSnapshot. Copies the data dir of a stopped RM aside under the
+// given label, replacing any earlier snapshot with that label. The
+// harness's own log files are not included. Snapshots live under
+// Setup.Dir, so are kept or archived along with it.
+
+type RMSnapshot struct {
+	*RM
+	label string
+}
+
+func (rm *RM) Snapshot(label string) *RMSnapshot {
+	return &RMSnapshot{
+		RM:    rm,
+		label: label,
+	}
+}
+
+func (rms *RMSnapshot) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rms))
+
+	err := rms.snapshot(l)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (rms *RMSnapshot) snapshot(l *log.Logger) error {
+	if err := rms.stopped(); err != nil {
+		return err
+	}
+	src := rms.dataDir()
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("RM %s has no data to snapshot: %v", rms.name, err)
+	}
+	dest := rms.snapshotDir(rms.label)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	l.Printf("Copying %s to %s...", src, dest)
+	files, bytes, err := copyTree(src, dest)
+	if err != nil {
+		return err
+	}
+	l.Printf("Copying %s to %s...done: %d files, %d bytes", src, dest, files, bytes)
+	return nil
+}
+
+func (rms *RMSnapshot) String() string {
+	return fmt.Sprintf("Snapshot:%v(%s)", rms.name, rms.label)
+}
+
+func (rms *RMSnapshot) Describe() string {
+	return fmt.Sprintf("Snapshot the data of stopped RM %s as %q", rms.name, rms.label)
+}
+
+// RMRestore. Replaces the data dir of a stopped RM with the snapshot
+// taken earlier under the given label. The harness's own log files
+// are kept, so the RM's output carries on across the restore.
+
+type RMRestore struct {
+	*RM
+	label string
+}
+
+func (rm *RM) Restore(label string) *RMRestore {
+	return &RMRestore{
+		RM:    rm,
+		label: label,
+	}
+}
+
+func (rmr *RMRestore) Exec(ctx context.Context, l *log.Logger) error {
+	parentPrefix := l.Prefix()
+	defer l.SetPrefix(parentPrefix)
+	l.SetPrefix(fmt.Sprintf("%s|%v", parentPrefix, rmr))
+
+	err := rmr.restore(l)
+	if err != nil {
+		l.Printf("Error encountered: %v", err)
+	}
+	return err
+}
+
+func (rmr *RMRestore) restore(l *log.Logger) error {
+	if err := rmr.stopped(); err != nil {
+		return err
+	}
+	src := rmr.snapshotDir(rmr.label)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("No snapshot %q of RM %s: %v", rmr.label, rmr.name, err)
+	}
+	dest := rmr.dataDir()
+	entries, err := readDirNames(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range entries {
+		if !harnessFiles[name] {
+			if err := os.RemoveAll(filepath.Join(dest, name)); err != nil {
+				return err
+			}
+		}
+	}
+	l.Printf("Copying %s to %s...", src, dest)
+	files, bytes, err := copyTree(src, dest)
+	if err != nil {
+		return err
+	}
+	l.Printf("Copying %s to %s...done: %d files, %d bytes", src, dest, files, bytes)
+	return nil
+}
+
+func (rmr *RMRestore) String() string {
+	return fmt.Sprintf("Restore:%v(%s)", rmr.name, rmr.label)
+}
+
+func (rmr *RMRestore) Describe() string {
+	return fmt.Sprintf("Restore the data of stopped RM %s from snapshot %q", rmr.name, rmr.label)
+}
+
+// copyTree copies the dir src to dest, preserving modes and symlinks,
+// but skipping the harness's own files at the top level.
+func copyTree(src, dest string) (files int, bytes int64, err error) {
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if harnessFiles[rel] {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return os.MkdirAll(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			files++
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			n, err := copyFile(path, target, mode.Perm())
+			files++
+			bytes += n
+			return err
+		default:
+			return fmt.Errorf("Unable to copy %s: unsupported file mode %v", path, mode)
+		}
+	})
+	return files, bytes, err
+}
+
+func copyFile(src, dest string, perm os.FileMode) (n int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if errClose := out.Close(); err == nil {
+			err = errClose
+		}
+	}()
+	return io.Copy(out, in)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	h "goshawkdb.io/tests/harness"
+	"log"
+	"time"
+)
+
+func main() {
+	setup := h.NewSetup()
+
+	config := setup.NewClusterConfig("certrotation", 1, 5)
+
+	rm1 := setup.NewRM("one", 0, nil, config.Path())
+	rm2 := setup.NewRM("two", 0, nil, config.Path())
+	rm3 := setup.NewRM("three", 0, nil, config.Path())
+	config.RMs = []*h.RM{rm1, rm2, rm3}
+
+	alice := setup.NewClientCertificate("alice")
+	bob := setup.NewClientCertificate("bob")
+	config.GrantClient(alice, "test", true, true)
+
+	alice1 := setup.NewClientSession(alice, rm1)
+	bob2 := setup.NewClientSession(bob, rm2)
+
+	prog := h.Program([]h.Instruction{
+		setup,
+		config.Write(),
+		setup.InParallel(rm1.Start(), rm2.Start(), rm3.Start()),
+		setup.InParallel(rm1.AwaitReady(), rm2.AwaitReady(), rm3.AwaitReady()),
+
+		alice1.Connect(),
+		alice1.ExpectWorking(),
+
+		config.AddClient(bob, "test", true, false),
+		bob2.Connect(),
+		bob2.ExpectWorking(),
+
+		config.RevokeClient(alice),
+		alice1.ExpectRejected(30 * time.Second),
+		bob2.ExpectWorking(),
+
+		bob2.Close(),
+		alice1.Close(),
+		setup.InParallel(rm1.Terminate(), rm2.Terminate(), rm3.Terminate()),
+		setup.InParallel(rm1.Wait(), rm2.Wait(), rm3.Wait()),
+	})
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
+}
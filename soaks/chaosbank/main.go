@@ -0,0 +1,47 @@
+package main
+
+import (
+	"goshawkdb.io/tests/banktransfer"
+	h "goshawkdb.io/tests/harness"
+	"goshawkdb.io/tests/harness/chaos"
+	"log"
+	"time"
+)
+
+func main() {
+	setup := h.NewSetup()
+
+	config := setup.NewClusterConfig("chaosbank", 1, 5)
+
+	rm1 := setup.NewRM("one", 0, nil, config.Path())
+	rm2 := setup.NewRM("two", 0, nil, config.Path())
+	rm3 := setup.NewRM("three", 0, nil, config.Path())
+	config.RMs = []*h.RM{rm1, rm2, rm3}
+
+	stoppableTest := setup.UntilStopped(
+		setup.Workload("banktransfer", banktransfer.BankTransfer, rm1))
+
+	stoppableServers := chaos.Periodically(setup, chaos.Interval{Min: 5 * time.Second, Max: 10 * time.Second},
+		chaos.RandomKill(setup, []*h.RM{rm2, rm3}, 1, chaos.Interval{Min: 1 * time.Second, Max: 5 * time.Second}))
+
+	prog := h.Program([]h.Instruction{
+		setup,
+		config.Write(),
+		setup.InParallel(rm1.Start(), rm2.Start(), rm3.Start()),
+		setup.InParallel(rm1.AwaitReady(), rm2.AwaitReady(), rm3.AwaitReady()),
+
+		setup.InParallel(
+			stoppableTest,
+			stoppableServers,
+
+			h.Program([]h.Instruction{
+				setup.Sleep(10 * time.Minute),
+				stoppableServers.Stop(),
+				stoppableTest.Stop(),
+			}),
+		),
+	})
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
+}
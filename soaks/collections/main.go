@@ -2,7 +2,10 @@ package main
 
 import (
 	h "goshawkdb.io/tests/harness"
+	"goshawkdb.io/tests/harness/chaos"
 	"log"
+	"os"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -10,9 +13,13 @@ import (
 func main() {
 	setup := h.NewSetup()
 
-	rm1 := setup.NewRM("one", 10001, nil, nil)
-	rm2 := setup.NewRM("two", 10002, nil, nil)
-	rm3 := setup.NewRM("three", 10003, nil, nil)
+	config := setup.NewClusterConfig("collections", 1, 5)
+
+	rm1 := setup.NewRM("one", 0, nil, config.Path())
+	rm2 := setup.NewRM("two", 0, nil, config.Path())
+	rm3 := setup.NewRM("three", 0, nil, config.Path())
+	config.RMs = []*h.RM{rm1, rm2, rm3}
+	hosts := []string{rm1.Host(), rm2.Host(), rm3.Host()}
 
 	goPP, err := h.NewPathProvider("go", true)
 	if err != nil {
@@ -27,7 +34,7 @@ func main() {
 		goPP,
 		[]string{"test", "-timeout=1h", "-run", "Soak"},
 		cwdPP,
-		nil,
+		append(os.Environ(), "GOSHAWKDB_CLUSTER_HOSTS="+strings.Join(hosts, ",")),
 	)
 
 	stoppableTest := setup.UntilStopped(h.Program([]h.Instruction{
@@ -36,24 +43,14 @@ func main() {
 		setup.Sleep(5 * time.Second),
 	}))
 
-	stoppableServers := setup.UntilStopped(h.Program([]h.Instruction{
-		setup.SleepRandom(5*time.Second, 10*time.Second),
-		rm2.Terminate(),
-		setup.SleepRandom(1*time.Second, 5*time.Second),
-		rm3.Terminate(),
-		rm2.Wait(),
-		rm3.Wait(),
-		setup.SleepRandom(1*time.Second, 5*time.Second),
-		rm3.Start(),
-		setup.SleepRandom(1*time.Second, 5*time.Second),
-		rm2.Start(),
-	}))
+	stoppableServers := chaos.Periodically(setup, chaos.Interval{Min: 5 * time.Second, Max: 10 * time.Second},
+		chaos.StaggeredRestart(setup, []*h.RM{rm2, rm3}, chaos.Interval{Min: 1 * time.Second, Max: 5 * time.Second}))
 
 	prog := h.Program([]h.Instruction{
 		setup,
+		config.Write(),
 		setup.InParallel(rm1.Start(), rm2.Start(), rm3.Start()),
-
-		setup.Sleep(5 * time.Second),
+		setup.InParallel(rm1.AwaitReady(), rm2.AwaitReady(), rm3.AwaitReady()),
 
 		setup.InParallel(
 
@@ -65,14 +62,12 @@ func main() {
 				stoppableTest.Stop(),
 				stoppableServers.Stop(), // will leave all 3 running
 				setup.Sleep(30 * time.Second),
-				rm1.Signal(syscall.SIGUSR1),
-				setup.Sleep(time.Second),
-				rm2.Signal(syscall.SIGUSR1),
-				setup.Sleep(time.Second),
-				rm3.Signal(syscall.SIGUSR1),
+				chaos.StaggeredSignal(setup, []*h.RM{rm1, rm2, rm3}, syscall.SIGUSR1, chaos.Interval{Min: time.Second}),
 				setup.Sleep(30 * time.Second),
 			}),
 		),
 	})
-	log.Println(h.Run(setup, prog))
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -9,21 +9,35 @@ import (
 
 func main() {
 	setup := h.NewSetup()
+	setup.SampleInterval = 10 * time.Second
 
 	dalmations := 31 // yeah yeah, I know
+	config := setup.NewClusterConfig("dalmationCluster", 15, 128)
 
 	rms := make([]*h.RM, dalmations)
 	rmsStart := make([]h.Instruction, dalmations)
+	rmsCheck := make([]h.Instruction, dalmations)
 	for idx := range rms {
-		rms[idx] = setup.NewRM(fmt.Sprintf("dalmation%v", idx), uint16(10000+idx), nil, nil)
+		rms[idx] = setup.NewRM(fmt.Sprintf("dalmation%v", idx), 0, nil, config.Path())
 		rmsStart[idx] = rms[idx].Start()
+		// Catch leaks: once settled, RSS shouldn't keep climbing.
+		rmsCheck[idx] = rms[idx].ExpectResources(h.ResourceBounds{
+			MaxRSSGrowth: 50,
+			Warmup:       2 * time.Minute,
+		})
 	}
 
+	config.RMs = rms
+
 	prog := h.Program([]h.Instruction{
 		setup,
+		config.Write(),
 		setup.InParallel(rmsStart...),
 
 		setup.Sleep(20 * time.Minute),
+		setup.InParallel(rmsCheck...),
 	})
-	log.Println(h.Run(setup, prog))
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
 }
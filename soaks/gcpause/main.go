@@ -0,0 +1,62 @@
+package main
+
+import (
+	"goshawkdb.io/tests/banktransfer"
+	h "goshawkdb.io/tests/harness"
+	"goshawkdb.io/tests/strongserializable"
+	"log"
+	"time"
+)
+
+func main() {
+	setup := h.NewSetup()
+
+	config := setup.NewClusterConfig("gcpause", 1, 5)
+
+	rm1 := setup.NewRM("one", 0, nil, config.Path())
+	rm2 := setup.NewRM("two", 0, nil, config.Path())
+	rm3 := setup.NewRM("three", 0, nil, config.Path())
+	config.RMs = []*h.RM{rm1, rm2, rm3}
+
+	// Both workloads use the root object, so they take turns.
+	stoppableTest := setup.UntilStopped(h.Program([]h.Instruction{
+		setup.Workload("banktransfer", banktransfer.BankTransfer, rm1),
+		setup.Workload("strongserializable", strongserializable.StrongSerializable, rm1),
+	}))
+
+	stoppablePauses := setup.UntilStopped(h.Program([]h.Instruction{
+		setup.SleepRandom(2*time.Second, 10*time.Second),
+		setup.PickOne(
+			setup.PauseFor(rm2, 1*time.Second, 20*time.Second),
+			setup.PauseFor(rm3, 1*time.Second, 20*time.Second),
+		),
+	}))
+
+	prog := h.Program([]h.Instruction{
+		setup,
+		config.Write(),
+		setup.InParallel(rm1.Start(), rm2.Start(), rm3.Start()),
+		setup.InParallel(rm1.AwaitReady(), rm2.AwaitReady(), rm3.AwaitReady()),
+
+		setup.InParallel(
+			stoppableTest,
+			stoppablePauses,
+
+			h.Program([]h.Instruction{
+				setup.Sleep(10 * time.Minute),
+				stoppablePauses.Stop(),
+				stoppableTest.Stop(),
+			}),
+		),
+
+		rm1.Terminate(),
+		rm2.Terminate(),
+		rm3.Terminate(),
+		rm1.Wait(),
+		rm2.Wait(),
+		rm3.Wait(),
+	})
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"goshawkdb.io/tests/banktransfer"
+	h "goshawkdb.io/tests/harness"
+	"log"
+	"os"
+	"time"
+)
+
+// Starts a cluster on the goshawkdb binary in GOSHAWKDB_OLD_BINARY
+// and upgrades it, one RM at a time, to the usual binary (-goshawkdb
+// or GOSHAWKDB_BINARY), with a workload running throughout. The data
+// is checked after each upgrade.
+func main() {
+	setup := h.NewSetup()
+
+	oldBinary := os.Getenv("GOSHAWKDB_OLD_BINARY")
+	if len(oldBinary) == 0 {
+		log.Fatal("GOSHAWKDB_OLD_BINARY must be set")
+	}
+	oldPP, err := h.NewPathProvider(oldBinary, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := setup.NewClusterConfig("rollingupgrade", 1, 5)
+
+	rm1 := setup.NewRM("one", 0, nil, config.Path())
+	rm2 := setup.NewRM("two", 0, nil, config.Path())
+	rm3 := setup.NewRM("three", 0, nil, config.Path())
+	rms := []*h.RM{rm1, rm2, rm3}
+	config.RMs = rms
+	for _, rm := range rms {
+		rm.SetBinary(oldPP)
+	}
+
+	integrity := setup.NewIntegrity(64)
+
+	// The workload runs through an RM which is not being upgraded.
+	upgrade := func(rm, via *h.RM) h.Instruction {
+		stoppableTest := setup.UntilStopped(
+			setup.Workload("banktransfer", banktransfer.BankTransfer, via))
+		return h.Program([]h.Instruction{
+			setup.InParallel(
+				stoppableTest,
+
+				h.Program([]h.Instruction{
+					setup.Sleep(1 * time.Minute),
+					rm.Terminate(),
+					rm.ExpectExit(false),
+					rm.SwapBinary(setup.GosBin),
+					rm.Start(),
+					rm.AwaitReady(),
+					setup.Sleep(1 * time.Minute),
+					stoppableTest.Stop(),
+				}),
+			),
+			integrity.Verify(rms...),
+		})
+	}
+
+	prog := h.Program([]h.Instruction{
+		setup,
+		config.Write(),
+		setup.InParallel(rm1.Start(), rm2.Start(), rm3.Start()),
+		setup.InParallel(rm1.AwaitReady(), rm2.AwaitReady(), rm3.AwaitReady()),
+		integrity.Seed(rm1),
+
+		upgrade(rm2, rm1),
+		upgrade(rm3, rm1),
+		upgrade(rm1, rm2),
+
+		rm1.Terminate(),
+		rm2.Terminate(),
+		rm3.Terminate(),
+		rm1.ExpectExit(false),
+		rm2.ExpectExit(false),
+		rm3.ExpectExit(false),
+	})
+	if err := h.Run(setup, prog); err != nil {
+		log.Fatal(err)
+	}
+}